@@ -12,6 +12,8 @@ import (
 	"yume-go/internal/api"
 	"yume-go/internal/bot"
 	"yume-go/internal/config"
+	"yume-go/internal/httpx"
+	"yume-go/internal/storage"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joho/godotenv"
@@ -28,9 +30,9 @@ func main() {
 		log.Println("No .env file found, using system environment")
 	}
 
-	cfg := config.Load()
-	if cfg.BotToken == "" {
-		log.Fatal("TELEGRAM_BOT_TOKEN is required")
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
 	}
 
 	telegramBot, err := tgbotapi.NewBotAPI(cfg.BotToken)
@@ -39,10 +41,24 @@ func main() {
 	}
 	log.Printf("Authorized on account @%s", telegramBot.Self.UserName)
 
-	apiClient := api.NewAPIClient(cfg.WaifuImURL, cfg.WaifuPicsURL, cfg.WaifuItURL)
+	httpClient, err := httpx.NewClient(httpx.Options{
+		ProxyURL:   cfg.HTTPProxyURL,
+		MaxRetries: cfg.HTTPMaxRetries,
+	})
+	if err != nil {
+		log.Fatal("Failed to create HTTP client:", err)
+	}
+
+	apiClient := api.NewAPIClient(httpClient)
 	log.Println("API Client initialized")
 	log.Printf("Priority: %s -> %s -> %s", cfg.APIPrimary, cfg.APISecondary, cfg.APITertiary)
 
+	store, err := storage.Open(cfg.DataFile)
+	if err != nil {
+		log.Fatal("Failed to open storage:", err)
+	}
+	store.StartAutoFlush(30 * time.Second)
+
 	go startHealthCheck()
 
 	time.AfterFunc(2*time.Second, func() {
@@ -50,7 +66,11 @@ func main() {
 		startKeepAlive(url, 4*time.Minute)
 	})
 
-	router := bot.NewRouter(telegramBot, apiClient, cfg)
+	holder := config.NewHolder(cfg)
+	go holder.Watch(10 * time.Second)
+
+	router := bot.NewRouter(telegramBot, apiClient, holder, store)
+	log.Printf("Workers: %d, queue size: %d, policy when full: %s", cfg.WorkerCount, cfg.WorkerQueueSize, cfg.QueueFullPolicy)
 	router.Start()
 }
 
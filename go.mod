@@ -5,3 +5,5 @@ go 1.25.4
 require github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
 
 require github.com/joho/godotenv v1.5.1
+
+require gopkg.in/yaml.v3 v3.0.1
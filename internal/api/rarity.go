@@ -0,0 +1,30 @@
+package api
+
+import (
+	"hash/fnv"
+
+	"yume-go/internal/config"
+)
+
+// RarityFor picks a tier for imageID. The pick is derived from the ID, so
+// the same artwork always has the same rarity.
+func RarityFor(imageID string, table []config.Rarity) config.Rarity {
+	total := 0
+	for _, r := range table {
+		total += r.Weight
+	}
+	if total <= 0 {
+		return config.Rarity{}
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(imageID))
+	n := int(h.Sum64() % uint64(total))
+	cum := 0
+	for _, r := range table {
+		cum += r.Weight
+		if n < cum {
+			return r
+		}
+	}
+	return table[len(table)-1]
+}
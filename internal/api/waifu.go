@@ -11,11 +11,14 @@ import (
 	"math/big"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"yume-go/internal/config"
+	"yume-go/internal/metrics"
 )
 
 type Waifu struct {
@@ -27,37 +30,139 @@ type Waifu struct {
 	Character string   `json:"character"`
 	Origin    string   `json:"origin"`
 	Artist    string   `json:"artist"`
+	ArtistURL string   `json:"artist_url"`
 	PageURL   string   `json:"page_url"`
 }
 
-type APIClient struct {
-	WaifuImURL   string
-	WaifuPicsURL string
-	WaifuItURL   string
+// artistField accepts the artist either as a plain name or as the object
+// waifu.im returns, keeping the first profile link it finds.
+type artistField struct {
+	Name string
+	URL  string
+}
+
+func (a *artistField) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &a.Name)
+	}
+	var obj struct {
+		Name       string `json:"name"`
+		Pixiv      string `json:"pixiv"`
+		Twitter    string `json:"twitter"`
+		DeviantArt string `json:"deviant_art"`
+		Patreon    string `json:"patreon"`
+	}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return err
+	}
+	a.Name = obj.Name
+	a.URL = firstNonEmpty(obj.Pixiv, obj.Twitter, obj.DeviantArt, obj.Patreon)
+	return nil
+}
 
+// APIClient talks to the waifu providers. Base URLs and weights come from
+// the config passed to each fetch, so a reloaded config applies at once.
+type APIClient struct {
 	http *http.Client
 
+	// mu guards the health maps and stats; handlers and the prefetcher
+	// fetch concurrently.
+	mu        sync.Mutex
 	failCount map[string]int
 	lastFail  map[string]time.Time
+	stats     map[string]*ProviderStats
+}
+
+// ProviderStats counts the outcomes of calls to one provider since start.
+type ProviderStats struct {
+	Name      string
+	Successes int64
+	Failures  int64
+	LastError string
+	// Latency is the total time spent on calls, for averaging.
+	Latency time.Duration
+}
+
+// SuccessRate returns the share of successful calls, or 0 without calls.
+func (s ProviderStats) SuccessRate() float64 {
+	total := s.Successes + s.Failures
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Successes) / float64(total)
+}
+
+// AvgLatency returns the mean call duration.
+func (s ProviderStats) AvgLatency() time.Duration {
+	total := s.Successes + s.Failures
+	if total == 0 {
+		return 0
+	}
+	return s.Latency / time.Duration(total)
 }
 
-func NewAPIClient(waifuImURL, waifuPicsURL, waifuItURL string) *APIClient {
+func NewAPIClient(httpClient *http.Client) *APIClient {
 	return &APIClient{
-		WaifuImURL:   waifuImURL,
-		WaifuPicsURL: waifuPicsURL,
-		WaifuItURL:   waifuItURL,
-		http: &http.Client{
-			Timeout: 15 * time.Second,
-		},
+		http:      httpClient,
 		failCount: make(map[string]int),
 		lastFail:  make(map[string]time.Time),
+		stats:     make(map[string]*ProviderStats),
 	}
 }
 
-func (c *APIClient) resetFail(name string) { c.failCount[name] = 0 }
-func (c *APIClient) markFail(name string)  { c.failCount[name]++; c.lastFail[name] = time.Now() }
+// Stats returns a snapshot of the per-provider counters, sorted by name.
+func (c *APIClient) Stats() []ProviderStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]ProviderStats, 0, len(c.stats))
+	for _, s := range c.stats {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (c *APIClient) record(name string, took time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.stats[name]
+	if !ok {
+		s = &ProviderStats{Name: name}
+		c.stats[name] = s
+	}
+	s.Latency += took
+	if err != nil {
+		s.Failures++
+		s.LastError = err.Error()
+		metrics.ProviderRequests.Add(name+":error", 1)
+		return
+	}
+	s.Successes++
+	metrics.ProviderRequests.Add(name+":ok", 1)
+}
+
+// HTTP returns the shared client, for other requests to the same sources.
+func (c *APIClient) HTTP() *http.Client { return c.http }
+
+func (c *APIClient) resetFail(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failCount[name] = 0
+}
+
+func (c *APIClient) markFail(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failCount[name]++
+	c.lastFail[name] = time.Now()
+}
 
 func (c *APIClient) isTemporarilyUnhealthy(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.failCount[name] >= 3 && time.Since(c.lastFail[name]) < 2*time.Minute {
 		return time.Since(c.lastFail[name]) < 5*time.Minute
 	}
@@ -96,28 +201,13 @@ func StableNumericID(prefix, raw string) string {
 	return strconv.FormatUint(h.Sum64(), 10)
 }
 
-func parseWeights(spec string) map[string]int {
-	out := map[string]int{}
-	parts := strings.Split(spec, ",")
-	for _, p := range parts {
-		kv := strings.Split(strings.TrimSpace(p), ":")
-		if len(kv) != 2 {
-			continue
-		}
-		name := strings.TrimSpace(kv[0])
-		w, err := strconv.Atoi(strings.TrimSpace(kv[1]))
-		if err != nil || w <= 0 {
-			continue
-		}
-		out[name] = w
-	}
-	return out
-}
-
 func pickWeighted(weights map[string]int, unhealthy func(name string) bool) string {
 	total := 0
 	effective := map[string]int{}
 	for name, w := range weights {
+		if w <= 0 {
+			continue
+		}
 		if unhealthy != nil && unhealthy(name) {
 			w = 1
 		}
@@ -140,8 +230,7 @@ func pickWeighted(weights map[string]int, unhealthy func(name string) bool) stri
 }
 
 func (c *APIClient) FetchRandomWaifu(isNSFW bool, apiPriority []string, cfg *config.Config) (*Waifu, error) {
-	weights := parseWeights(cfg.WaifuWeights)
-	chosen := pickWeighted(weights, c.isTemporarilyUnhealthy)
+	chosen := pickWeighted(cfg.Weights, c.isTemporarilyUnhealthy)
 
 	tryOrder := make([]string, 0, 4)
 	if chosen != "" {
@@ -167,18 +256,23 @@ func (c *APIClient) FetchRandomWaifu(isNSFW bool, apiPriority []string, cfg *con
 		var w *Waifu
 		var err error
 
+		start := time.Now()
 		switch src {
 		case "waifu.im":
-			w, err = c.fetchFromWaifuIm(isNSFW)
+			w, err = c.fetchFromWaifuIm(cfg.WaifuImURL, isNSFW)
 		case "waifu.pics":
-			w, err = c.fetchFromWaifuPics(isNSFW)
+			w, err = c.fetchFromWaifuPics(cfg.WaifuPicsURL, isNSFW)
 		case "waifu.it":
-			w, err = c.fetchFromWaifuIt(isNSFW)
+			w, err = c.fetchFromWaifuIt(cfg.WaifuItURL, isNSFW)
 		default:
 			err = fmt.Errorf("unknown source: %s", src)
 		}
 
-		if err != nil || w == nil || w.URL == "" {
+		if err == nil && (w == nil || w.URL == "") {
+			err = errors.New("empty result")
+		}
+		c.record(src, time.Since(start), err)
+		if err != nil {
 			c.markFail(src)
 			lastErr = fmt.Errorf("source %s failed: %w", src, err)
 			log.Printf("[gacha] source=%s error=%v", src, err)
@@ -192,8 +286,21 @@ func (c *APIClient) FetchRandomWaifu(isNSFW bool, apiPriority []string, cfg *con
 	return nil, lastErr
 }
 
-func (c *APIClient) fetchFromWaifuIm(isNSFW bool) (*Waifu, error) {
-	u, _ := url.Parse(c.WaifuImURL)
+// FetchUnseenWaifu re-rolls FetchRandomWaifu while seen reports the result
+// as recently shown, up to maxRerolls times. After that the repeat is
+// accepted rather than failing the pull.
+func (c *APIClient) FetchUnseenWaifu(isNSFW bool, apiPriority []string, cfg *config.Config, seen func(*Waifu) bool, maxRerolls int) (*Waifu, error) {
+	for attempt := 0; ; attempt++ {
+		w, err := c.FetchRandomWaifu(isNSFW, apiPriority, cfg)
+		if err != nil || seen == nil || attempt >= maxRerolls || !seen(w) {
+			return w, err
+		}
+		log.Printf("[gacha] %s from %s seen recently, re-rolling (%d/%d)", w.ImageID, w.Source, attempt+1, maxRerolls)
+	}
+}
+
+func (c *APIClient) fetchFromWaifuIm(baseURL string, isNSFW bool) (*Waifu, error) {
+	u, _ := url.Parse(baseURL)
 	q := u.Query()
 	q.Set("is_nsfw", strconv.FormatBool(isNSFW))
 	q.Set("many", "false")
@@ -203,7 +310,6 @@ func (c *APIClient) fetchFromWaifuIm(isNSFW bool) (*Waifu, error) {
 	defer cancel()
 
 	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-	req.Header.Set("User-Agent", "yume-go/1.0")
 	resp, err := c.http.Do(req)
 	if err != nil {
 		return nil, err
@@ -215,15 +321,15 @@ func (c *APIClient) fetchFromWaifuIm(isNSFW bool) (*Waifu, error) {
 
 	var payload struct {
 		Images []struct {
-			URL       string   `json:"url"`
-			ImageID   string   `json:"image_id"`
-			Tags      []string `json:"tags"`
-			Source    string   `json:"source"`
-			Character string   `json:"character"`
-			Origin    string   `json:"origin"`
-			Artist    string   `json:"artist"`
-			PageURL   string   `json:"page_url"`
-			Name      string   `json:"name"`
+			URL       string      `json:"url"`
+			ImageID   string      `json:"image_id"`
+			Tags      []string    `json:"tags"`
+			Source    string      `json:"source"`
+			Character string      `json:"character"`
+			Origin    string      `json:"origin"`
+			Artist    artistField `json:"artist"`
+			PageURL   string      `json:"page_url"`
+			Name      string      `json:"name"`
 		} `json:"images"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
@@ -242,24 +348,23 @@ func (c *APIClient) fetchFromWaifuIm(isNSFW bool) (*Waifu, error) {
 		Tags:      img.Tags,
 		Character: img.Character,
 		Origin:    img.Origin,
-		Artist:    img.Artist,
-		PageURL:   img.PageURL,
+		Artist:    img.Artist.Name,
+		ArtistURL: img.Artist.URL,
+		PageURL:   firstNonEmpty(img.PageURL, img.Source),
 	}, nil
 }
 
-func (c *APIClient) fetchFromWaifuPics(isNSFW bool) (*Waifu, error) {
+func (c *APIClient) fetchFromWaifuPics(baseURL string, isNSFW bool) (*Waifu, error) {
 	mode := "sfw"
 	if isNSFW {
 		mode = "nsfw"
 	}
-	u := fmt.Sprintf("%s/%s/waifu", strings.TrimRight(c.WaifuPicsURL, "/"), mode)
+	u := fmt.Sprintf("%s/%s/waifu", strings.TrimRight(baseURL, "/"), mode)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 12*time.Second)
 	defer cancel()
 
 	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
-	req.Header.Set("User-Agent", "yume-go/1.0")
-
 	resp, err := c.http.Do(req)
 	if err != nil {
 		return nil, err
@@ -287,15 +392,13 @@ func (c *APIClient) fetchFromWaifuPics(isNSFW bool) (*Waifu, error) {
 	}, nil
 }
 
-func (c *APIClient) fetchFromWaifuIt(isNSFW bool) (*Waifu, error) {
-	u := fmt.Sprintf("%s/random?nsfw=%t", strings.TrimRight(c.WaifuItURL, "/"), isNSFW)
+func (c *APIClient) fetchFromWaifuIt(baseURL string, isNSFW bool) (*Waifu, error) {
+	u := fmt.Sprintf("%s/random?nsfw=%t", strings.TrimRight(baseURL, "/"), isNSFW)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 12*time.Second)
 	defer cancel()
 
 	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
-	req.Header.Set("User-Agent", "yume-go/1.0")
-
 	resp, err := c.http.Do(req)
 	if err != nil {
 		return nil, err
@@ -306,14 +409,14 @@ func (c *APIClient) fetchFromWaifuIt(isNSFW bool) (*Waifu, error) {
 	}
 
 	var payload struct {
-		URL       string   `json:"url"`
-		ID        string   `json:"id"`
-		Name      string   `json:"name"`
-		Tags      []string `json:"tags"`
-		Character string   `json:"character"`
-		Origin    string   `json:"origin"`
-		Artist    string   `json:"artist"`
-		PageURL   string   `json:"page_url"`
+		URL       string      `json:"url"`
+		ID        string      `json:"id"`
+		Name      string      `json:"name"`
+		Tags      []string    `json:"tags"`
+		Character string      `json:"character"`
+		Origin    string      `json:"origin"`
+		Artist    artistField `json:"artist"`
+		PageURL   string      `json:"page_url"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
 		return nil, err
@@ -331,7 +434,8 @@ func (c *APIClient) fetchFromWaifuIt(isNSFW bool) (*Waifu, error) {
 		Tags:      payload.Tags,
 		Character: payload.Character,
 		Origin:    payload.Origin,
-		Artist:    payload.Artist,
+		Artist:    payload.Artist.Name,
+		ArtistURL: payload.Artist.URL,
 		PageURL:   payload.PageURL,
 	}, nil
 }
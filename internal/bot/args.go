@@ -0,0 +1,244 @@
+package bot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"yume-go/internal/i18n"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+type ArgKind int
+
+const (
+	ArgString ArgKind = iota
+	ArgInt
+	// ArgUser accepts @username, a numeric ID, a tg://user?id= link or a
+	// text mention and resolves it to a user ID.
+	ArgUser
+	// ArgText consumes the rest of the line verbatim.
+	ArgText
+)
+
+// Arg declares one positional argument of a command.
+type Arg struct {
+	Name     string
+	Kind     ArgKind
+	Optional bool
+	Choices  []string
+	// Min and Max bound ArgInt values when Max > Min.
+	Min, Max int
+}
+
+// Params holds the typed values parsed for a command's Args.
+type Params map[string]any
+
+func (p Params) Has(name string) bool {
+	_, ok := p[name]
+	return ok
+}
+
+func (p Params) String(name string) string {
+	s, _ := p[name].(string)
+	return s
+}
+
+func (p Params) Int(name string) int {
+	n, _ := p[name].(int)
+	return n
+}
+
+func (p Params) User(name string) int64 {
+	id, _ := p[name].(int64)
+	return id
+}
+
+// UsageError makes the router reply with the command's usage. Handlers
+// may return one for checks the declarative Args cannot express. Key is
+// an i18n message key formatted with Args.
+type UsageError struct {
+	Key  string
+	Args []any
+}
+
+func (e *UsageError) Error() string { return e.Reason(i18n.Default) }
+
+// Reason returns the message in lang.
+func (e *UsageError) Reason(lang string) string {
+	return i18n.T(lang, e.Key, e.Args...)
+}
+
+func usageErrorf(key string, a ...any) *UsageError {
+	return &UsageError{Key: key, Args: a}
+}
+
+type token struct {
+	text  string
+	start int
+}
+
+// splitArgs splits s on whitespace, keeping "double-quoted" (or “curly”)
+// runs together and honouring backslash escapes. Single quotes are left
+// alone so words like "don't" survive.
+func splitArgs(s string) ([]token, error) {
+	var (
+		out     []token
+		cur     strings.Builder
+		start   = -1
+		closing rune
+		escaped bool
+	)
+	flush := func() {
+		if start >= 0 {
+			out = append(out, token{text: cur.String(), start: start})
+		}
+		cur.Reset()
+		start = -1
+	}
+
+	for i, r := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+			if start < 0 {
+				start = i
+			}
+		case closing != 0:
+			if r == closing {
+				closing = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '"' || r == '“':
+			closing = '"'
+			if r == '“' {
+				closing = '”'
+			}
+			if start < 0 {
+				start = i
+			}
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			cur.WriteRune(r)
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if closing != 0 {
+		return nil, usageErrorf("usage.unterminated_quote")
+	}
+	flush()
+	return out, nil
+}
+
+// commandArguments returns the text after the command, with text mentions
+// rewritten to tg://user?id= links so they survive tokenizing.
+func commandArguments(msg *tgbotapi.Message) string {
+	text := msg.Text
+	var mentions []tgbotapi.MessageEntity
+	for _, e := range msg.Entities {
+		if e.Type == "text_mention" && e.User != nil {
+			mentions = append(mentions, e)
+		}
+	}
+	if len(mentions) > 0 {
+		units := utf16.Encode([]rune(text))
+		for i := len(mentions) - 1; i >= 0; i-- {
+			e := mentions[i]
+			if e.Offset < 0 || e.Offset+e.Length > len(units) {
+				continue
+			}
+			link := utf16.Encode([]rune(fmt.Sprintf("tg://user?id=%d", e.User.ID)))
+			units = append(units[:e.Offset], append(link, units[e.Offset+e.Length:]...)...)
+		}
+		text = string(utf16.Decode(units))
+	}
+
+	text = strings.TrimLeft(text, " ")
+	space := strings.IndexFunc(text, unicode.IsSpace)
+	if space == -1 {
+		return ""
+	}
+	return strings.TrimSpace(text[space:])
+}
+
+func (r *Router) resolveUser(s string) (int64, error) {
+	if rest, ok := strings.CutPrefix(s, "tg://user?id="); ok {
+		s = rest
+	}
+	if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return id, nil
+	}
+	if name, ok := strings.CutPrefix(s, "@"); ok {
+		if id, found := r.store.FindUsername(name); found {
+			return id, nil
+		}
+		return 0, usageErrorf("usage.unknown_user", s)
+	}
+	return 0, usageErrorf("usage.not_user", s)
+}
+
+// parseParams fills c.Params from the tokens according to specs.
+func (r *Router) parseParams(specs []Arg, c *Context, raw string, tokens []token) error {
+	c.Params = Params{}
+	for i, spec := range specs {
+		if i >= len(tokens) {
+			if !spec.Optional {
+				return usageErrorf("usage.missing", spec.Name)
+			}
+			continue
+		}
+		tok := tokens[i].text
+
+		switch spec.Kind {
+		case ArgText:
+			c.Params[spec.Name] = strings.TrimSpace(raw[tokens[i].start:])
+			return nil
+		case ArgInt:
+			n, err := strconv.Atoi(tok)
+			if err != nil {
+				return usageErrorf("usage.not_number", spec.Name)
+			}
+			if spec.Max > spec.Min && (n < spec.Min || n > spec.Max) {
+				return usageErrorf("usage.range", spec.Name, spec.Min, spec.Max)
+			}
+			c.Params[spec.Name] = n
+		case ArgUser:
+			id, err := r.resolveUser(tok)
+			if err != nil {
+				return err
+			}
+			c.Params[spec.Name] = id
+		default:
+			if len(spec.Choices) > 0 && !containsFold(spec.Choices, tok) {
+				return usageErrorf("usage.choices", spec.Name, strings.Join(spec.Choices, ", "))
+			}
+			if len(spec.Choices) > 0 {
+				tok = strings.ToLower(tok)
+			}
+			c.Params[spec.Name] = tok
+		}
+	}
+	if len(tokens) > len(specs) {
+		return usageErrorf("usage.too_many")
+	}
+	return nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package bot
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"yume-go/internal/storage"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		in     string
+		texts  []string
+		starts []int
+	}{
+		{"", nil, nil},
+		{"   ", nil, nil},
+		{"on", []string{"on"}, []int{0}},
+		{"  a   b ", []string{"a", "b"}, []int{2, 6}},
+		{`say "hello world" now`, []string{"say", "hello world", "now"}, []int{0, 4, 18}},
+		{`a""b`, []string{"ab"}, []int{0}},
+		{`""`, []string{""}, []int{0}},
+		{"“curly quotes” x", []string{"curly quotes", "x"}, []int{0, 19}},
+		{`back\ slash \"q\"`, []string{"back slash", `"q"`}, []int{0, 12}},
+		{`"in \" quote"`, []string{`in " quote`}, []int{0}},
+		{"don't stop", []string{"don't", "stop"}, []int{0, 6}},
+		{"tab\tand\nnewline", []string{"tab", "and", "newline"}, []int{0, 4, 8}},
+	}
+	for _, tt := range tests {
+		tokens, err := splitArgs(tt.in)
+		if err != nil {
+			t.Errorf("splitArgs(%q): %v", tt.in, err)
+			continue
+		}
+		var texts []string
+		var starts []int
+		for _, tok := range tokens {
+			texts = append(texts, tok.text)
+			starts = append(starts, tok.start)
+		}
+		if !reflect.DeepEqual(texts, tt.texts) || !reflect.DeepEqual(starts, tt.starts) {
+			t.Errorf("splitArgs(%q) = %q at %v, want %q at %v", tt.in, texts, starts, tt.texts, tt.starts)
+		}
+	}
+}
+
+func TestSplitArgsUnterminatedQuote(t *testing.T) {
+	for _, in := range []string{`"open`, "“open", `a "b c`} {
+		_, err := splitArgs(in)
+		var usage *UsageError
+		if !errors.As(err, &usage) || usage.Key != "usage.unterminated_quote" {
+			t.Errorf("splitArgs(%q) error = %v, want usage.unterminated_quote", in, err)
+		}
+	}
+}
+
+func TestCommandArguments(t *testing.T) {
+	mention := func(offset, length int, id int64) tgbotapi.MessageEntity {
+		return tgbotapi.MessageEntity{Type: "text_mention", Offset: offset, Length: length, User: &tgbotapi.User{ID: id}}
+	}
+	tests := []struct {
+		name     string
+		text     string
+		entities []tgbotapi.MessageEntity
+		want     string
+	}{
+		{"no arguments", "/gacha", nil, ""},
+		{"trailing space", "/gacha   ", nil, ""},
+		{"plain", "/anu on", nil, "on"},
+		{"trimmed", "  /anu   on  ", nil, "on"},
+		{"newline separator", "/admin\nbroadcast hi", nil, "broadcast hi"},
+		{"text mention", "/ban Bob spam", []tgbotapi.MessageEntity{mention(5, 3, 42)}, "tg://user?id=42 spam"},
+		{
+			// 😀 is two UTF-16 code units, so the mention starts at 8.
+			"offset after astral rune",
+			"/ban 😀 Bob spam",
+			[]tgbotapi.MessageEntity{mention(8, 3, 42)},
+			"😀 tg://user?id=42 spam",
+		},
+		{
+			"two mentions",
+			"/ban Ann Bob",
+			[]tgbotapi.MessageEntity{mention(5, 3, 1), mention(9, 3, 2)},
+			"tg://user?id=1 tg://user?id=2",
+		},
+		{"mention past the end is ignored", "/ban Bob", []tgbotapi.MessageEntity{mention(5, 10, 42)}, "Bob"},
+		{"other entities are ignored", "/ban @bob", []tgbotapi.MessageEntity{{Type: "mention", Offset: 5, Length: 4}}, "@bob"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &tgbotapi.Message{Text: tt.text, Entities: tt.entities}
+			if got := commandArguments(msg); got != tt.want {
+				t.Errorf("commandArguments(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	store, err := storage.Open(filepath.Join(t.TempDir(), "data.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.TouchUser(7, "Alice")
+	r := &Router{store: store}
+
+	specs := []Arg{
+		{Name: "user", Kind: ArgUser},
+		{Name: "mode", Optional: true, Choices: []string{"on", "off"}},
+		{Name: "count", Kind: ArgInt, Optional: true, Min: 1, Max: 10},
+	}
+	tests := []struct {
+		raw     string
+		want    Params
+		wantErr string
+	}{
+		{"@alice", Params{"user": int64(7)}, ""},
+		{"123 ON 5", Params{"user": int64(123), "mode": "on", "count": 5}, ""},
+		{"tg://user?id=9 off", Params{"user": int64(9), "mode": "off"}, ""},
+		{"", nil, "usage.missing"},
+		{"@nobody", nil, "usage.unknown_user"},
+		{"bob", nil, "usage.not_user"},
+		{"1 maybe", nil, "usage.choices"},
+		{"1 on x", nil, "usage.not_number"},
+		{"1 on 0", nil, "usage.range"},
+		{"1 on 11", nil, "usage.range"},
+		{"1 on 10", Params{"user": int64(1), "mode": "on", "count": 10}, ""},
+		{"1 on 2 extra", nil, "usage.too_many"},
+	}
+	for _, tt := range tests {
+		tokens, err := splitArgs(tt.raw)
+		if err != nil {
+			t.Fatalf("splitArgs(%q): %v", tt.raw, err)
+		}
+		c := &Context{}
+		err = r.parseParams(specs, c, tt.raw, tokens)
+		if tt.wantErr != "" {
+			var usage *UsageError
+			if !errors.As(err, &usage) || usage.Key != tt.wantErr {
+				t.Errorf("parseParams(%q) error = %v, want %s", tt.raw, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseParams(%q): %v", tt.raw, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.Params, tt.want) {
+			t.Errorf("parseParams(%q) = %v, want %v", tt.raw, c.Params, tt.want)
+		}
+	}
+}
+
+func TestParseParamsText(t *testing.T) {
+	r := &Router{}
+	specs := []Arg{
+		{Name: "action", Choices: []string{"broadcast"}},
+		{Name: "text", Kind: ArgText},
+	}
+	raw := `broadcast  Hello "everyone",  see you!`
+	tokens, err := splitArgs(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Context{}
+	if err := r.parseParams(specs, c, raw, tokens); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Params.String("text"), `Hello "everyone",  see you!`; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+}
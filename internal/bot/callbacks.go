@@ -0,0 +1,54 @@
+package bot
+
+import (
+	"log"
+	"strings"
+
+	"yume-go/internal/handler"
+	"yume-go/internal/i18n"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// OnCallback routes inline button presses whose data starts with
+// "prefix:" to h. The remaining colon-separated parts become Context.Args.
+func (r *Router) OnCallback(prefix string, h HandlerFunc) {
+	if r.callbacks == nil {
+		r.callbacks = make(map[string]HandlerFunc)
+	}
+	r.callbacks[prefix] = h
+}
+
+func (r *Router) handleCallback(q *tgbotapi.CallbackQuery) {
+	if q.Message == nil {
+		return
+	}
+	if r.banned(q.From, q.Message.Chat, "callback "+q.Data) {
+		lang := handler.Lang(r.store, q.Message.Chat, q.From)
+		r.bot.Request(tgbotapi.NewCallback(q.ID, i18n.T(lang, "ban.banned")))
+		return
+	}
+
+	parts := strings.Split(q.Data, ":")
+	h, ok := r.callbacks[parts[0]]
+	if !ok {
+		log.Printf("No callback handler for %q", q.Data)
+		r.bot.Request(tgbotapi.NewCallback(q.ID, ""))
+		return
+	}
+
+	ctx := &Context{
+		Bot:      r.bot,
+		Message:  q.Message,
+		Callback: q,
+		Command:  "callback:" + parts[0],
+		RawArgs:  strings.Join(parts[1:], ":"),
+		Args:     parts[1:],
+		Params:   Params{},
+		User:     q.From,
+		Chat:     q.Message.Chat,
+		Settings: r.store.Chat(q.Message.Chat.ID),
+		Lang:     handler.Lang(r.store, q.Message.Chat, q.From),
+	}
+	r.submit(ctx, h)
+}
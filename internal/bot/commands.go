@@ -0,0 +1,252 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"yume-go/internal/handler"
+	"yume-go/internal/i18n"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Scope restricts where, and by whom, a command may be used.
+type Scope int
+
+const (
+	ScopeAll Scope = iota
+	ScopePrivate
+	ScopeGroup
+	ScopeAdmin
+)
+
+// Command describes a registered command. The registry is the single
+// source for dispatch, /help and the list published to Telegram.
+type Command struct {
+	Name        string
+	Description string
+	Usage       string
+	Aliases     []string
+	Scope       Scope
+	Hidden      bool
+	Handler     HandlerFunc
+
+	// Args are parsed into Context.Params before Handler runs.
+	Args []Arg
+	// Subcommands are matched against the first argument. When none
+	// matches, Handler runs if set, otherwise the usage is shown.
+	Subcommands []*Command
+}
+
+func (cmd *Command) subcommand(name string) *Command {
+	for _, sub := range cmd.Subcommands {
+		if strings.EqualFold(sub.Name, name) || containsFold(sub.Aliases, name) {
+			return sub
+		}
+	}
+	return nil
+}
+
+// description returns the "cmd.<name>" catalog entry in lang, falling
+// back to Description for commands without one.
+func (cmd *Command) description(lang string) string {
+	if key := "cmd." + cmd.Name; i18n.Has(lang, key) {
+		return i18n.T(lang, key)
+	}
+	return cmd.Description
+}
+
+// usage returns the declared Usage or derives one from Args and
+// Subcommands, e.g. "/anu <on|off|status>".
+func (cmd *Command) usage(path string) string {
+	if cmd.Usage != "" {
+		return cmd.Usage
+	}
+	var sb strings.Builder
+	sb.WriteString(path)
+	if len(cmd.Subcommands) > 0 {
+		names := make([]string, len(cmd.Subcommands))
+		for i, sub := range cmd.Subcommands {
+			names[i] = sub.Name
+		}
+		if cmd.Handler != nil {
+			fmt.Fprintf(&sb, " [%s]", strings.Join(names, "|"))
+		} else {
+			fmt.Fprintf(&sb, " <%s>", strings.Join(names, "|"))
+		}
+	}
+	for _, arg := range cmd.Args {
+		name := arg.Name
+		if len(arg.Choices) > 0 {
+			name = strings.Join(arg.Choices, "|")
+		}
+		if arg.Optional {
+			fmt.Fprintf(&sb, " [%s]", name)
+		} else {
+			fmt.Fprintf(&sb, " <%s>", name)
+		}
+	}
+	return sb.String()
+}
+
+// Register adds commands to the router. Names and aliases are matched
+// case-insensitively; a later registration wins on conflict.
+func (r *Router) Register(cmds ...*Command) {
+	if r.lookup == nil {
+		r.lookup = make(map[string]*Command)
+	}
+	for _, cmd := range cmds {
+		r.commands = append(r.commands, cmd)
+		r.lookup[strings.ToLower(cmd.Name)] = cmd
+		for _, alias := range cmd.Aliases {
+			r.lookup[strings.ToLower(alias)] = cmd
+		}
+	}
+}
+
+// allowed reports whether cmd may run in the context's chat, and if not,
+// the message to reply with.
+func (r *Router) allowed(cmd *Command, c *Context) (bool, string) {
+	switch cmd.Scope {
+	case ScopePrivate:
+		if !c.Chat.IsPrivate() {
+			return false, i18n.T(c.Lang, "bot.private_only")
+		}
+	case ScopeGroup:
+		if !c.Chat.IsGroup() && !c.Chat.IsSuperGroup() {
+			return false, i18n.T(c.Lang, "bot.group_only")
+		}
+	case ScopeAdmin:
+		if !r.config.Get().IsAdmin(c.UserID()) {
+			return false, i18n.T(c.Lang, "bot.unknown_command")
+		}
+	}
+	return true, ""
+}
+
+// visibleTo lists the commands worth showing in /help for this context.
+func (r *Router) visibleTo(c *Context) []handler.CommandInfo {
+	var out []handler.CommandInfo
+	for _, cmd := range r.commands {
+		if cmd.Hidden {
+			continue
+		}
+		if ok, _ := r.allowed(cmd, c); !ok {
+			continue
+		}
+		out = append(out, handler.CommandInfo{
+			Name:        cmd.Name,
+			Description: cmd.description(c.Lang),
+			Usage:       cmd.usage("/" + cmd.Name),
+			Aliases:     cmd.Aliases,
+		})
+	}
+	return out
+}
+
+// invoke descends into subcommands, parses arguments and runs the
+// handler. Usage errors are answered here so handlers don't have to.
+func (r *Router) invoke(cmd *Command) HandlerFunc {
+	return func(c *Context) error {
+		target, path := cmd, "/"+cmd.Name
+
+		tokens, err := splitArgs(c.RawArgs)
+		for err == nil && len(tokens) > 0 {
+			sub := target.subcommand(tokens[0].text)
+			if sub == nil {
+				break
+			}
+			if ok, reply := r.allowed(sub, c); !ok {
+				return c.Reply(reply)
+			}
+			target, path = sub, path+" "+sub.Name
+			c.Subcommand = strings.TrimPrefix(path, "/"+cmd.Name+" ")
+			tokens = tokens[1:]
+		}
+
+		if err == nil {
+			c.Args = c.Args[:0]
+			for _, t := range tokens {
+				c.Args = append(c.Args, t.text)
+			}
+			if target.Handler == nil {
+				err = usageErrorf("usage.missing_subcommand")
+			} else {
+				err = r.parseParams(target.Args, c, c.RawArgs, tokens)
+			}
+		}
+		if err == nil {
+			err = target.Handler(c)
+		}
+
+		var usageErr *UsageError
+		if errors.As(err, &usageErr) {
+			return c.Reply(i18n.T(c.Lang, "usage.error", usageErr.Reason(c.Lang), target.usage(path)))
+		}
+		return err
+	}
+}
+
+func (r *Router) help(c *Context) error {
+	topic := ""
+	if c.Params.Has("command") {
+		topic = strings.ToLower(strings.TrimPrefix(c.Params.String("command"), "/"))
+		if cmd, ok := r.lookup[topic]; ok {
+			topic = cmd.Name
+		}
+	}
+	handler.HandleHelp(c.Bot, c.Message, r.visibleTo(c), topic, c.Lang)
+	return nil
+}
+
+// PublishCommands sends the visible, non-admin commands to Telegram so
+// clients can offer them in the command menu, once per supported language.
+func (r *Router) PublishCommands() {
+	for _, lang := range i18n.Supported() {
+		if err := r.publishCommands(lang); err != nil {
+			log.Printf("Failed to publish %s commands: %v", lang, err)
+			return
+		}
+	}
+	log.Println("Published command list to Telegram")
+}
+
+func (r *Router) publishCommands(lang string) error {
+	var all, private, group []tgbotapi.BotCommand
+	for _, cmd := range r.commands {
+		if cmd.Hidden || cmd.Scope == ScopeAdmin {
+			continue
+		}
+		bc := tgbotapi.BotCommand{Command: cmd.Name, Description: cmd.description(lang)}
+		switch cmd.Scope {
+		case ScopeAll:
+			all = append(all, bc)
+			private = append(private, bc)
+			group = append(group, bc)
+		case ScopePrivate:
+			private = append(private, bc)
+		case ScopeGroup:
+			group = append(group, bc)
+		}
+	}
+
+	// The default language doubles as the list for clients in languages
+	// without a catalog.
+	code := lang
+	if lang == i18n.Default {
+		code = ""
+	}
+	configs := []tgbotapi.SetMyCommandsConfig{
+		tgbotapi.NewSetMyCommandsWithScopeAndLanguage(tgbotapi.NewBotCommandScopeDefault(), code, all...),
+		tgbotapi.NewSetMyCommandsWithScopeAndLanguage(tgbotapi.NewBotCommandScopeAllPrivateChats(), code, private...),
+		tgbotapi.NewSetMyCommandsWithScopeAndLanguage(tgbotapi.NewBotCommandScopeAllGroupChats(), code, group...),
+	}
+	for _, cfg := range configs {
+		if _, err := r.bot.Request(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package bot
+
+import (
+	"strings"
+
+	"yume-go/internal/storage"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Context is built once per incoming command and passed down the
+// middleware chain to the handler.
+type Context struct {
+	Bot     *tgbotapi.BotAPI
+	Message *tgbotapi.Message
+	// Callback is set when the context comes from an inline button press;
+	// Message is then the message the button was attached to.
+	Callback *tgbotapi.CallbackQuery
+	Command  string
+	// Subcommand is the space-separated path below Command, if any.
+	Subcommand string
+	RawArgs    string
+	Args       []string
+	Params     Params
+	User       *tgbotapi.User
+	Chat       *tgbotapi.Chat
+	// Settings is a snapshot of the chat's stored settings at dispatch.
+	Settings storage.Chat
+	// Lang is the language to reply in, see handler.Lang.
+	Lang string
+
+	values map[string]any
+}
+
+type HandlerFunc func(*Context) error
+
+type Middleware func(HandlerFunc) HandlerFunc
+
+func newContext(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, cmd string) *Context {
+	raw := commandArguments(msg)
+	return &Context{
+		Bot:     bot,
+		Message: msg,
+		Command: cmd,
+		RawArgs: raw,
+		Args:    strings.Fields(raw),
+		Params:  Params{},
+		User:    msg.From,
+		Chat:    msg.Chat,
+	}
+}
+
+// UserID returns the sender's ID, or 0 for messages without a sender.
+func (c *Context) UserID() int64 {
+	if c.User == nil {
+		return 0
+	}
+	return c.User.ID
+}
+
+func (c *Context) Reply(text string) error {
+	_, err := c.Bot.Send(tgbotapi.NewMessage(c.Chat.ID, text))
+	return err
+}
+
+func (c *Context) Set(key string, value any) {
+	if c.values == nil {
+		c.values = make(map[string]any)
+	}
+	c.values[key] = value
+}
+
+func (c *Context) Get(key string) (any, bool) {
+	v, ok := c.values[key]
+	return v, ok
+}
+
+// chain wraps h so that the first middleware is the outermost one.
+func chain(h HandlerFunc, mws []Middleware) HandlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
@@ -0,0 +1,74 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"yume-go/internal/i18n"
+	"yume-go/internal/metrics"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Logger logs every dispatched command with its sender and duration.
+func Logger() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			username, userID := "unknown", int64(0)
+			if c.User != nil {
+				username, userID = c.User.UserName, c.User.ID
+			}
+			if c.Callback != nil {
+				log.Printf("Callback from @%s (ID: %d): %s", username, userID, c.Callback.Data)
+			} else {
+				log.Printf("Message from @%s (ID: %d): %s", username, userID, c.Message.Text)
+			}
+
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				log.Printf("/%s failed after %s: %v", c.Command, time.Since(start), err)
+			}
+			return err
+		}
+	}
+}
+
+// Recover turns a panicking handler into an error reply instead of taking
+// the whole bot down. When adminChatID is set, a short report is forwarded
+// there as well.
+func Recover(adminChatID int64) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) (err error) {
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				stack := debug.Stack()
+				metrics.HandlerPanics.Add(c.Command, 1)
+				log.Printf("panic in /%s (chat: %d, user: %d, message: %d): %v\n%s",
+					c.Command, c.Chat.ID, c.UserID(), c.Message.MessageID, p, stack)
+
+				c.Reply(i18n.T(c.Lang, "bot.panic"))
+
+				if adminChatID != 0 {
+					report := fmt.Sprintf("⚠️ panic in /%s\nchat: %d\nuser: %d\ntext: %s\n\n%v\n\n%s",
+						c.Command, c.Chat.ID, c.UserID(), c.Message.Text, p, stack)
+					if len(report) > 4000 {
+						report = strings.ToValidUTF8(report[:4000], "")
+					}
+					if _, sendErr := c.Bot.Send(tgbotapi.NewMessage(adminChatID, report)); sendErr != nil {
+						log.Printf("Failed to send panic report: %v", sendErr)
+					}
+				}
+
+				err = fmt.Errorf("panic: %v", p)
+			}()
+			return next(c)
+		}
+	}
+}
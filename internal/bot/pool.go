@@ -0,0 +1,87 @@
+package bot
+
+import (
+	"sync"
+
+	"yume-go/internal/metrics"
+)
+
+// WorkerPool runs handlers on a fixed number of workers. Every chat is
+// pinned to one worker so replies within a chat keep their order; the
+// trade-off is that a slow handler delays other chats on the same worker.
+type WorkerPool struct {
+	queues []chan func()
+	block  bool
+	wg     sync.WaitGroup
+}
+
+func NewWorkerPool(workers, queueSize int, block bool) *WorkerPool {
+	if workers <= 0 {
+		workers = 1
+	}
+	perWorker := queueSize / workers
+	if perWorker <= 0 {
+		perWorker = 1
+	}
+
+	p := &WorkerPool{
+		queues: make([]chan func(), workers),
+		block:  block,
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), perWorker)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+func (p *WorkerPool) work(queue chan func()) {
+	defer p.wg.Done()
+	for job := range queue {
+		metrics.QueueDepth.Add(-1)
+		job()
+	}
+}
+
+func (p *WorkerPool) shard(chatID int64) chan func() {
+	n := uint64(chatID) % uint64(len(p.queues))
+	return p.queues[n]
+}
+
+// Submit queues job for chatID. When the worker's queue is full it either
+// waits for room or reports false, depending on the pool's policy.
+func (p *WorkerPool) Submit(chatID int64, job func()) bool {
+	queue := p.shard(chatID)
+	metrics.QueueDepth.Add(1)
+
+	if p.block {
+		queue <- job
+		return true
+	}
+
+	select {
+	case queue <- job:
+		return true
+	default:
+		metrics.QueueDepth.Add(-1)
+		metrics.QueueRejected.Add(1)
+		return false
+	}
+}
+
+func (p *WorkerPool) Depth() int64 {
+	return metrics.QueueDepth.Value()
+}
+
+func (p *WorkerPool) Workers() int {
+	return len(p.queues)
+}
+
+// Stop drains the queued jobs and waits for the workers to finish.
+func (p *WorkerPool) Stop() {
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+}
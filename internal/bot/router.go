@@ -3,11 +3,15 @@ package bot
 import (
 	"log"
 	"strings"
-	"sync"
+	"time"
 
 	"yume-go/internal/api"
 	"yume-go/internal/config"
 	"yume-go/internal/handler"
+	"yume-go/internal/i18n"
+	"yume-go/internal/prefetch"
+	"yume-go/internal/storage"
+	"yume-go/internal/util"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
@@ -15,9 +19,16 @@ import (
 type Router struct {
 	bot       *tgbotapi.BotAPI
 	apiClient *api.APIClient
-	config    *config.Config
-	wg        sync.WaitGroup
-	commands  map[string]func(*tgbotapi.BotAPI, *tgbotapi.Message)
+	config    *config.Holder
+	pool      *WorkerPool
+	commands  []*Command
+	lookup    map[string]*Command
+	store     *storage.Store
+	callbacks map[string]HandlerFunc
+	prefetch  *prefetch.Prefetcher
+	started   time.Time
+
+	middleware []Middleware
 }
 
 func normalizeCommand(text, botUsername string) string {
@@ -63,59 +74,290 @@ func parseCommand(text string) (cmd string, ok bool) {
 	return strings.ToLower(raw), true
 }
 
-func NewRouter(bot *tgbotapi.BotAPI, apiClient *api.APIClient, cfg *config.Config) *Router {
+// NewRouter wires up the commands. Settings read per request come from
+// the holder, so reloads apply to the next command.
+func NewRouter(bot *tgbotapi.BotAPI, apiClient *api.APIClient, holder *config.Holder, store *storage.Store) *Router {
+	cfg := holder.Get()
 	r := &Router{
 		bot:       bot,
 		apiClient: apiClient,
-		config:    cfg,
+		config:    holder,
+		pool:      NewWorkerPool(cfg.WorkerCount, cfg.WorkerQueueSize, cfg.QueueFullPolicy == "block"),
+		store:     store,
+		started:   time.Now(),
 	}
 
-	r.commands = map[string]func(*tgbotapi.BotAPI, *tgbotapi.Message){
-		"start": handler.HandleStart,
-		"help":  handler.HandleHelp,
-		"anu":   handler.HandleAnuToggleUser,
-	}
+	r.prefetch = prefetch.New(func(b prefetch.Bucket) (*api.Waifu, *util.DownloadResult, error) {
+		return handler.FetchAndDownload(r.apiClient, r.cfg(), b.NSFW, nil)
+	}, cfg.PrefetchSize, cfg.PrefetchInterval)
 
-	r.commands["gacha"] = func(bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
-		handler.HandleGacha(bot, msg, r.apiClient, r.config)
-	}
+	r.Register(
+		&Command{
+			Name:        "start",
+			Description: "Start the bot",
+			Handler: func(c *Context) error {
+				handler.HandleStart(c.Bot, c.Message, c.Lang)
+				return nil
+			},
+		},
+		&Command{
+			Name:        "help",
+			Description: "Show this help menu",
+			Args:        []Arg{{Name: "command", Optional: true}},
+			Handler:     r.help,
+		},
+		&Command{
+			Name:        "gacha",
+			Description: "Get a random waifu",
+			Aliases:     []string{"roll"},
+			Handler: func(c *Context) error {
+				handler.HandleGacha(c.Bot, c.Message, r.apiClient, r.cfg(), r.store, r.prefetch)
+				return nil
+			},
+		},
+		&Command{
+			Name:        "anu",
+			Description: "Turn anu mode on or off",
+			Scope:       ScopePrivate,
+			Subcommands: []*Command{
+				{Name: "on", Handler: func(c *Context) error {
+					handler.HandleAnuSet(c.Bot, c.Message, r.store, r.cfg(), true)
+					return nil
+				}},
+				{Name: "off", Handler: func(c *Context) error {
+					handler.HandleAnuSet(c.Bot, c.Message, r.store, r.cfg(), false)
+					return nil
+				}},
+				{Name: "status", Handler: func(c *Context) error {
+					handler.HandleAnuStatus(c.Bot, c.Message, r.store)
+					return nil
+				}},
+			},
+		},
+		&Command{
+			Name:        "forcesfw",
+			Description: "Show or set the global SFW kill switch",
+			Scope:       ScopeAdmin,
+			Args:        []Arg{{Name: "state", Optional: true, Choices: []string{"on", "off"}}},
+			Handler: func(c *Context) error {
+				handler.HandleForceSFW(c.Bot, c.Message, r.store, r.cfg(), c.Params.String("state"))
+				return nil
+			},
+		},
+		&Command{
+			Name:        "policy",
+			Description: "Show or set this chat's content policy",
+			Args:        []Arg{{Name: "policy", Optional: true, Choices: storage.Policies}},
+			Handler: func(c *Context) error {
+				handler.HandlePolicy(c.Bot, c.Message, r.store, c.Params.String("policy"))
+				return nil
+			},
+		},
+		&Command{
+			Name:        "lang",
+			Description: "Show or change the bot language",
+			Args:        []Arg{{Name: "language", Optional: true, Choices: append(i18n.Supported(), "auto")}},
+			Handler: func(c *Context) error {
+				handler.HandleLang(c.Bot, c.Message, r.store, c.Params.String("language"))
+				return nil
+			},
+		},
+		&Command{
+			Name:        "ban",
+			Description: "Ban a user from the bot or this chat",
+			Usage:       "/ban <user> [global] [duration] [reason]",
+			Hidden:      true,
+			Args:        []Arg{{Name: "user", Kind: ArgUser}, {Name: "rest", Kind: ArgText, Optional: true}},
+			Handler: func(c *Context) error {
+				handler.HandleBan(c.Bot, c.Message, r.store, r.cfg(), c.Params.User("user"), c.Params.String("rest"))
+				return nil
+			},
+		},
+		&Command{
+			Name:        "unban",
+			Description: "Lift a user's ban",
+			Hidden:      true,
+			Args:        []Arg{{Name: "user", Kind: ArgUser}, {Name: "scope", Optional: true, Choices: []string{"global"}}},
+			Handler: func(c *Context) error {
+				handler.HandleUnban(c.Bot, c.Message, r.store, r.cfg(), c.Params.User("user"), c.Params.String("scope"))
+				return nil
+			},
+		},
+		&Command{
+			Name:        "admin",
+			Description: "Bot administration",
+			Scope:       ScopeAdmin,
+			Subcommands: []*Command{
+				{Name: "stats", Handler: func(c *Context) error {
+					handler.HandleAdminStats(c.Bot, c.Message, r.apiClient, r.store, r.runtimeStats())
+					return nil
+				}},
+				{Name: "reload", Handler: func(c *Context) error {
+					handler.HandleAdminReload(c.Bot, c.Message, r.store, r.config)
+					return nil
+				}},
+				{
+					Name: "broadcast",
+					Args: []Arg{{Name: "text", Kind: ArgText}},
+					Handler: func(c *Context) error {
+						handler.HandleBroadcast(c.Bot, c.Message, r.store, c.Params.String("text"))
+						return nil
+					},
+				},
+				{
+					Name: "source",
+					Args: []Arg{
+						{Name: "provider", Optional: true, Choices: config.Providers},
+						{Name: "action", Optional: true, Choices: []string{"on", "off", "weight", "reset"}},
+						{Name: "weight", Kind: ArgInt, Optional: true, Min: 0, Max: 1000},
+					},
+					Handler: func(c *Context) error {
+						action := c.Params.String("action")
+						if action == "weight" && !c.Params.Has("weight") {
+							return usageErrorf("usage.missing", "weight")
+						}
+						handler.HandleAdminSource(c.Bot, c.Message, r.store, r.config.Get(),
+							c.Params.String("provider"), action, c.Params.Int("weight"))
+						return nil
+					},
+				},
+			},
+		},
+	)
+
+	r.OnCallback("anu", func(c *Context) error {
+		accepted := len(c.Args) > 0 && c.Args[0] == "confirm"
+		handler.HandleAnuConsent(c.Bot, c.Callback, r.store, r.cfg(), accepted)
+		return nil
+	})
+
+	r.OnCallback("full", func(c *Context) error {
+		if len(c.Args) == 0 {
+			return nil
+		}
+		spoiler := len(c.Args) > 1 && c.Args[1] == "spoiler"
+		handler.HandleFullResolution(c.Bot, c.Callback, r.apiClient, r.cfg(), c.Args[0], spoiler, c.Lang)
+		return nil
+	})
+
+	r.OnCallback("bc", func(c *Context) error {
+		if len(c.Args) < 2 {
+			return nil
+		}
+		handler.HandleBroadcastConfirm(c.Bot, c.Callback, r.store, c.Args[1], c.Args[0] == "send")
+		return nil
+	})
+
+	r.Use(Logger(), Recover(cfg.AdminChatID))
 
 	return r
 }
 
+// cfg returns the current config with the runtime provider overrides
+// applied.
+func (r *Router) cfg() *config.Config {
+	return handler.WithSourceOverrides(r.config.Get(), r.store.Settings())
+}
+
+func (r *Router) runtimeStats() handler.RuntimeStats {
+	return handler.RuntimeStats{
+		Uptime:     time.Since(r.started),
+		Workers:    r.pool.Workers(),
+		QueueDepth: r.pool.Depth(),
+		Prefetched: r.prefetch.Len(prefetch.Bucket{}) + r.prefetch.Len(prefetch.Bucket{NSFW: true}),
+	}
+}
+
+// Use appends middleware to the chain wrapped around every command.
+// It must be called before Start.
+func (r *Router) Use(mw ...Middleware) {
+	r.middleware = append(r.middleware, mw...)
+}
+
 func (r *Router) Start() {
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 
+	r.PublishCommands()
+	r.prefetch.Warm(prefetch.Bucket{})
+
 	updates := r.bot.GetUpdatesChan(u)
 	log.Println("Bot is running. Press CTRL+C to stop.")
 
 	for update := range updates {
-		if update.Message == nil {
-			continue
+		switch {
+		case update.Message != nil:
+			r.handleMessage(update.Message)
+		case update.CallbackQuery != nil:
+			r.handleCallback(update.CallbackQuery)
 		}
+	}
 
-		original := update.Message.Text
-		botUsername := r.bot.Self.UserName
-		normalized := normalizeCommand(original, botUsername)
-		cmd, ok := parseCommand(normalized)
-		if !ok {
-			continue
-		}
+	r.pool.Stop()
+}
 
-		log.Printf("Message from @%s (ID: %d): %s",
-			update.Message.From.UserName,
-			update.Message.From.ID,
-			original)
-
-		if handlerFunc, exists := r.commands[cmd]; exists {
-			r.wg.Add(1)
-			go func(msg *tgbotapi.Message, hf func(*tgbotapi.BotAPI, *tgbotapi.Message)) {
-				defer r.wg.Done()
-				hf(r.bot, msg)
-			}(update.Message, handlerFunc)
-		} else {
-			r.bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, "Unknown command. Type /help for assistance."))
-		}
+func (r *Router) handleMessage(msg *tgbotapi.Message) {
+	r.track(msg)
+
+	normalized := normalizeCommand(msg.Text, r.bot.Self.UserName)
+	cmd, ok := parseCommand(normalized)
+	if !ok || r.banned(msg.From, msg.Chat, cmd) {
+		return
+	}
+
+	lang := handler.Lang(r.store, msg.Chat, msg.From)
+	command, exists := r.lookup[cmd]
+	if !exists {
+		r.bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "bot.unknown_command")))
+		return
+	}
+
+	ctx := newContext(r.bot, msg, command.Name)
+	ctx.Settings = r.store.Chat(msg.Chat.ID)
+	ctx.Lang = lang
+	if ok, reply := r.allowed(command, ctx); !ok {
+		r.bot.Send(tgbotapi.NewMessage(msg.Chat.ID, reply))
+		return
+	}
+	r.submit(ctx, r.invoke(command))
+}
+
+// banned reports whether user is banned in chat, so their commands and
+// button presses are dropped before any reply or queueing. Bot admins are
+// never held back.
+func (r *Router) banned(user *tgbotapi.User, chat *tgbotapi.Chat, what string) bool {
+	if user == nil || r.config.Get().IsAdmin(user.ID) {
+		return false
+	}
+	ban, ok := r.store.ActiveBan(user.ID, chat.ID)
+	if !ok {
+		return false
+	}
+	log.Printf("Ignoring %s from banned user %d in chat %d (ban chat: %d, reason: %q)",
+		what, user.ID, chat.ID, ban.ChatID, ban.Reason)
+	return true
+}
+
+// submit queues h wrapped in the middleware chain on the chat's worker.
+func (r *Router) submit(ctx *Context, h HandlerFunc) {
+	h = chain(h, r.middleware)
+	queued := r.pool.Submit(ctx.Chat.ID, func() {
+		_ = h(ctx)
+	})
+	if !queued {
+		log.Printf("Queue full, rejected %s from chat %d", ctx.Command, ctx.Chat.ID)
+		r.bot.Send(tgbotapi.NewMessage(ctx.Chat.ID, i18n.T(ctx.Lang, "bot.busy")))
+	}
+}
+
+// track remembers the chat and the users involved in msg so they can be
+// resolved by @username later.
+func (r *Router) track(msg *tgbotapi.Message) {
+	r.store.TouchChat(msg.Chat.ID, msg.Chat.Type)
+	if msg.From != nil {
+		r.store.TouchUser(msg.From.ID, msg.From.UserName)
+	}
+	if reply := msg.ReplyToMessage; reply != nil && reply.From != nil {
+		r.store.TouchUser(reply.From.ID, reply.From.UserName)
 	}
 }
@@ -1,37 +1,372 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 )
 
+// Providers lists the waifu sources the API client knows about.
+var Providers = []string{"waifu.im", "waifu.pics", "waifu.it"}
+
+// DefaultRarityTable is used when no rarity table is configured.
+const DefaultRarityTable = "Common:⚪:60,Rare:🔵:25,Epic:🟣:10,Legendary:🌟:5"
+
+// Rarity is one tier of the rarity table. Weight is relative to the other
+// tiers.
+type Rarity struct {
+	Name   string `yaml:"name"`
+	Emoji  string `yaml:"emoji"`
+	Weight int    `yaml:"weight"`
+}
+
+// CaptionFuncs are the functions CaptionTemplate may call.
+var CaptionFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// Fields tagged secret are never printed; see Diff.
 type Config struct {
-	BotToken     string
+	BotToken     string `secret:"true"`
 	APIPrimary   string
 	APISecondary string
 	APITertiary  string
 	WaifuImURL   string
 	WaifuPicsURL string
 	WaifuItURL   string
-	WaifuWeights string
+	// Weights biases the random pick between providers; see Providers.
+	Weights  map[string]int
+	DataFile string
+
+	// ForceSFW disables NSFW content everywhere regardless of user and
+	// chat settings. Admins can also flip it at runtime with /forcesfw.
+	ForceSFW bool
+
+	WorkerCount     int
+	WorkerQueueSize int
+	QueueFullPolicy string
+
+	// DownloadMemoryLimit is the largest download kept in memory; bigger
+	// files go through a temp folder.
+	DownloadMemoryLimit int64
+	DownloadMaxSize     int64
+	DownloadTimeout     time.Duration
+	// DownloadHostTimeouts overrides DownloadTimeout per host (and its
+	// subdomains), e.g. "i.waifu.pics:30s,waifu.im:90s".
+	DownloadHostTimeouts map[string]time.Duration
+	DownloadRetries      int
+
+	// HTTPProxyURL routes outgoing API and download requests through an
+	// http(s):// or socks5(h):// proxy. It may carry credentials.
+	HTTPProxyURL   string `secret:"true"`
+	HTTPMaxRetries int
+
+	// PrefetchSize is how many ready waifus to keep per bucket; 0 turns
+	// prefetching off. PrefetchInterval spaces out background fetches.
+	PrefetchSize     int
+	PrefetchInterval time.Duration
+
+	// DuplicateDistance is the largest perceptual hash distance, in bits,
+	// at which two images count as the same artwork.
+	DuplicateDistance int
+
+	// RecentWindow is how many recent images per user are avoided, and
+	// RerollLimit how many re-rolls a pull may spend avoiding them.
+	RecentWindow int
+	RerollLimit  int
+
+	// Rarities are the tiers an image can roll, see api.RarityFor.
+	Rarities []Rarity
+	// CaptionTemplate is a text/template for photo captions, rendered
+	// with Telegram HTML parse mode.
+	CaptionTemplate string
+
+	AdminChatID int64
+	AdminIDs    []int64
+}
+
+// DefaultFile is read when CONFIG_FILE is unset and the file exists.
+const DefaultFile = "config.yaml"
+
+// FilePath returns the config file Load reads, or "" if there is none.
+func FilePath() string {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		return path
+	}
+	if _, err := os.Stat(DefaultFile); err == nil {
+		return DefaultFile
+	}
+	return ""
 }
 
-func Load() *Config {
+func defaults() *Config {
+	rarities, _ := parseRarityTable(DefaultRarityTable)
 	return &Config{
-		BotToken:     getEnv("TELEGRAM_BOT_TOKEN", ""),
-		APIPrimary:   getEnv("WAIFU_API_PRIMARY", "waifu.im"),
-		APISecondary: getEnv("WAIFU_API_SECONDARY", "waifu.pics"),
-		APITertiary:  getEnv("WAIFU_API_TERTIARY", "waifu.it"),
-		WaifuImURL:   getEnv("WAIFU_IM_URL", "https://api.waifu.im/search"),
-		WaifuPicsURL: getEnv("WAIFU_PICS_URL", "https://api.waifu.pics"),
-		WaifuItURL:   getEnv("WAIFU_IT_URL", "https://waifu.it/api/v4"),
-		WaifuWeights: getEnv("WAIFU_WEIGHTS", "waifu.im:1,waifu.pics:1,waifu.it:1"),
+		APIPrimary:   "waifu.im",
+		APISecondary: "waifu.pics",
+		APITertiary:  "waifu.it",
+		WaifuImURL:   "https://api.waifu.im/search",
+		WaifuPicsURL: "https://api.waifu.pics",
+		WaifuItURL:   "https://waifu.it/api/v4",
+		Weights:      map[string]int{"waifu.im": 1, "waifu.pics": 1, "waifu.it": 1},
+		DataFile:     "data/yume.json",
+
+		WorkerCount:     8,
+		WorkerQueueSize: 64,
+		QueueFullPolicy: "reject",
+
+		DownloadMemoryLimit:  20 * 1024 * 1024,
+		DownloadMaxSize:      50 * 1024 * 1024,
+		DownloadTimeout:      60 * time.Second,
+		DownloadHostTimeouts: map[string]time.Duration{},
+		DownloadRetries:      2,
+
+		HTTPMaxRetries: 3,
+
+		PrefetchSize:     3,
+		PrefetchInterval: 2 * time.Second,
+
+		DuplicateDistance: 6,
+
+		RecentWindow: 20,
+		RerollLimit:  3,
+
+		Rarities: rarities,
 	}
+}
+
+// Load builds the config from defaults, then the optional YAML file named
+// by CONFIG_FILE (or DefaultFile if present), then environment variables.
+// Any malformed value or failed validation is returned as an error.
+func Load() (*Config, error) {
+	c := defaults()
+
+	if path := FilePath(); path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+		log.Printf("Loaded config file %s", path)
+	}
+
+	if err := c.loadEnv(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadEnv overrides c with the environment variables that are set.
+func (c *Config) loadEnv() error {
+	var e env
+	e.str("TELEGRAM_BOT_TOKEN", &c.BotToken)
+	e.str("WAIFU_API_PRIMARY", &c.APIPrimary)
+	e.str("WAIFU_API_SECONDARY", &c.APISecondary)
+	e.str("WAIFU_API_TERTIARY", &c.APITertiary)
+	e.str("WAIFU_IM_URL", &c.WaifuImURL)
+	e.str("WAIFU_PICS_URL", &c.WaifuPicsURL)
+	e.str("WAIFU_IT_URL", &c.WaifuItURL)
+	e.parse("WAIFU_WEIGHTS", func(v string) (err error) {
+		c.Weights, err = parseWeights(v)
+		return err
+	})
+	e.str("DATA_FILE", &c.DataFile)
+
+	e.boolean("FORCE_SFW", &c.ForceSFW)
+
+	e.integer("WORKER_COUNT", &c.WorkerCount)
+	e.integer("WORKER_QUEUE_SIZE", &c.WorkerQueueSize)
+	e.str("QUEUE_FULL_POLICY", &c.QueueFullPolicy)
 
+	e.megabytes("DOWNLOAD_MEMORY_LIMIT_MB", &c.DownloadMemoryLimit)
+	e.megabytes("DOWNLOAD_MAX_SIZE_MB", &c.DownloadMaxSize)
+	e.duration("DOWNLOAD_TIMEOUT", &c.DownloadTimeout)
+	e.parse("DOWNLOAD_HOST_TIMEOUTS", func(v string) (err error) {
+		c.DownloadHostTimeouts, err = parseHostDurations(v)
+		return err
+	})
+	e.integer("DOWNLOAD_RETRIES", &c.DownloadRetries)
+
+	e.str("HTTP_PROXY_URL", &c.HTTPProxyURL)
+	e.integer("HTTP_MAX_RETRIES", &c.HTTPMaxRetries)
+
+	e.integer("PREFETCH_SIZE", &c.PrefetchSize)
+	e.duration("PREFETCH_INTERVAL", &c.PrefetchInterval)
+
+	e.integer("DUPLICATE_DISTANCE", &c.DuplicateDistance)
+
+	e.integer("RECENT_WINDOW", &c.RecentWindow)
+	e.integer("REROLL_LIMIT", &c.RerollLimit)
+
+	e.parse("RARITY_TABLE", func(v string) (err error) {
+		c.Rarities, err = parseRarityTable(v)
+		return err
+	})
+	e.str("CAPTION_TEMPLATE", &c.CaptionTemplate)
+
+	e.int64("ADMIN_CHAT_ID", &c.AdminChatID)
+	e.parse("ADMIN_IDS", func(v string) (err error) {
+		c.AdminIDs, err = parseInt64List(v)
+		return err
+	})
+
+	return errors.Join(e.errs...)
+}
+
+// env reads environment variables into config fields, leaving fields
+// untouched when the variable is unset and collecting parse errors.
+type env struct {
+	errs []error
+}
+
+func (e *env) parse(key string, set func(string) error) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return
+	}
+	if err := set(v); err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s: %w", key, err))
+	}
+}
+
+func (e *env) str(key string, dst *string) {
+	e.parse(key, func(v string) error {
+		*dst = v
+		return nil
+	})
+}
+
+func (e *env) integer(key string, dst *int) {
+	e.parse(key, func(v string) (err error) {
+		*dst, err = strconv.Atoi(strings.TrimSpace(v))
+		return err
+	})
+}
+
+func (e *env) int64(key string, dst *int64) {
+	e.parse(key, func(v string) (err error) {
+		*dst, err = strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		return err
+	})
+}
+
+func (e *env) megabytes(key string, dst *int64) {
+	e.parse(key, func(v string) error {
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		*dst = n * 1024 * 1024
+		return err
+	})
+}
+
+func (e *env) boolean(key string, dst *bool) {
+	e.parse(key, func(v string) (err error) {
+		*dst, err = strconv.ParseBool(strings.TrimSpace(v))
+		return err
+	})
+}
+
+func (e *env) duration(key string, dst *time.Duration) {
+	e.parse(key, func(v string) (err error) {
+		*dst, err = time.ParseDuration(strings.TrimSpace(v))
+		return err
+	})
+}
+
+func parseInt64List(spec string) ([]int64, error) {
+	var out []int64
+	for _, p := range strings.Split(spec, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an ID", p)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// parseWeights reads "provider:weight" entries separated by commas.
+func parseWeights(spec string) (map[string]int, error) {
+	out := map[string]int{}
+	for _, p := range strings.Split(spec, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		name, w, ok := strings.Cut(p, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q: want provider:weight", p)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil {
+			return nil, fmt.Errorf("%q: weight is not a number", p)
+		}
+		out[strings.TrimSpace(name)] = n
+	}
+	return out, nil
+}
+
+// parseRarityTable reads "name:emoji:weight" entries separated by commas.
+// The emoji may be left out ("name:weight").
+func parseRarityTable(spec string) ([]Rarity, error) {
+	var out []Rarity
+	for _, p := range strings.Split(spec, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		parts := strings.Split(p, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("%q: want name:emoji:weight", p)
+		}
+		w, err := strconv.Atoi(strings.TrimSpace(parts[len(parts)-1]))
+		if err != nil {
+			return nil, fmt.Errorf("%q: weight is not a number", p)
+		}
+		r := Rarity{Name: strings.TrimSpace(parts[0]), Weight: w}
+		if len(parts) == 3 {
+			r.Emoji = strings.TrimSpace(parts[1])
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func (c *Config) IsAdmin(userID int64) bool {
+	for _, id := range c.AdminIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
 }
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// parseHostDurations reads "host:duration" entries separated by commas.
+func parseHostDurations(spec string) (map[string]time.Duration, error) {
+	out := map[string]time.Duration{}
+	for _, p := range strings.Split(spec, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		i := strings.LastIndexByte(p, ':')
+		if i == -1 {
+			return nil, fmt.Errorf("%q: want host:duration", p)
+		}
+		d, err := time.ParseDuration(p[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", p, err)
+		}
+		out[strings.ToLower(p[:i])] = d
 	}
-	return defaultValue
+	return out, nil
 }
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// file is the schema of the YAML config file. Every field is optional;
+// pointers tell "unset" apart from zero values that are valid settings.
+type file struct {
+	Telegram struct {
+		Token *string `yaml:"token"`
+	} `yaml:"telegram"`
+
+	Providers struct {
+		// Priority is the fallback order after the weighted pick.
+		Priority []string       `yaml:"priority"`
+		Weights  map[string]int `yaml:"weights"`
+		URLs     struct {
+			WaifuIm   *string `yaml:"waifu.im"`
+			WaifuPics *string `yaml:"waifu.pics"`
+			WaifuIt   *string `yaml:"waifu.it"`
+		} `yaml:"urls"`
+	} `yaml:"providers"`
+
+	Storage struct {
+		DataFile *string `yaml:"data_file"`
+	} `yaml:"storage"`
+
+	Content struct {
+		ForceSFW          *bool    `yaml:"force_sfw"`
+		DuplicateDistance *int     `yaml:"duplicate_distance"`
+		RecentWindow      *int     `yaml:"recent_window"`
+		RerollLimit       *int     `yaml:"reroll_limit"`
+		CaptionTemplate   *string  `yaml:"caption_template"`
+		Rarities          []Rarity `yaml:"rarities"`
+	} `yaml:"content"`
+
+	Workers struct {
+		Count           *int    `yaml:"count"`
+		QueueSize       *int    `yaml:"queue_size"`
+		QueueFullPolicy *string `yaml:"queue_full_policy"`
+	} `yaml:"workers"`
+
+	Downloads struct {
+		MemoryLimitMB *int64                   `yaml:"memory_limit_mb"`
+		MaxSizeMB     *int64                   `yaml:"max_size_mb"`
+		Timeout       *time.Duration           `yaml:"timeout"`
+		HostTimeouts  map[string]time.Duration `yaml:"host_timeouts"`
+		Retries       *int                     `yaml:"retries"`
+	} `yaml:"downloads"`
+
+	HTTP struct {
+		ProxyURL   *string `yaml:"proxy_url"`
+		MaxRetries *int    `yaml:"max_retries"`
+	} `yaml:"http"`
+
+	Prefetch struct {
+		Size     *int           `yaml:"size"`
+		Interval *time.Duration `yaml:"interval"`
+	} `yaml:"prefetch"`
+
+	Admin struct {
+		ChatID *int64  `yaml:"chat_id"`
+		IDs    []int64 `yaml:"ids"`
+	} `yaml:"admin"`
+}
+
+// loadFile overlays the YAML file at path onto c. Unknown keys are
+// rejected so typos don't go unnoticed.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var f file
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	// An empty or comment-only file decodes to io.EOF and sets nothing.
+	if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	set(&c.BotToken, f.Telegram.Token)
+
+	if p := f.Providers.Priority; len(p) > 0 {
+		if len(p) > 3 {
+			return fmt.Errorf("providers.priority: at most 3 providers, got %d", len(p))
+		}
+		p = append(p, "", "", "")
+		c.APIPrimary, c.APISecondary, c.APITertiary = p[0], p[1], p[2]
+	}
+	if f.Providers.Weights != nil {
+		c.Weights = f.Providers.Weights
+	}
+	set(&c.WaifuImURL, f.Providers.URLs.WaifuIm)
+	set(&c.WaifuPicsURL, f.Providers.URLs.WaifuPics)
+	set(&c.WaifuItURL, f.Providers.URLs.WaifuIt)
+
+	set(&c.DataFile, f.Storage.DataFile)
+
+	set(&c.ForceSFW, f.Content.ForceSFW)
+	set(&c.DuplicateDistance, f.Content.DuplicateDistance)
+	set(&c.RecentWindow, f.Content.RecentWindow)
+	set(&c.RerollLimit, f.Content.RerollLimit)
+	set(&c.CaptionTemplate, f.Content.CaptionTemplate)
+	if f.Content.Rarities != nil {
+		c.Rarities = f.Content.Rarities
+	}
+
+	set(&c.WorkerCount, f.Workers.Count)
+	set(&c.WorkerQueueSize, f.Workers.QueueSize)
+	set(&c.QueueFullPolicy, f.Workers.QueueFullPolicy)
+
+	if mb := f.Downloads.MemoryLimitMB; mb != nil {
+		c.DownloadMemoryLimit = *mb * 1024 * 1024
+	}
+	if mb := f.Downloads.MaxSizeMB; mb != nil {
+		c.DownloadMaxSize = *mb * 1024 * 1024
+	}
+	set(&c.DownloadTimeout, f.Downloads.Timeout)
+	if f.Downloads.HostTimeouts != nil {
+		c.DownloadHostTimeouts = map[string]time.Duration{}
+		for host, d := range f.Downloads.HostTimeouts {
+			c.DownloadHostTimeouts[strings.ToLower(host)] = d
+		}
+	}
+	set(&c.DownloadRetries, f.Downloads.Retries)
+
+	set(&c.HTTPProxyURL, f.HTTP.ProxyURL)
+	set(&c.HTTPMaxRetries, f.HTTP.MaxRetries)
+
+	set(&c.PrefetchSize, f.Prefetch.Size)
+	set(&c.PrefetchInterval, f.Prefetch.Interval)
+
+	set(&c.AdminChatID, f.Admin.ChatID)
+	if f.Admin.IDs != nil {
+		c.AdminIDs = f.Admin.IDs
+	}
+	return nil
+}
+
+func set[T any](dst *T, v *T) {
+	if v != nil {
+		*dst = *v
+	}
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// restartFields are read once at startup; reloading them only takes
+// effect after a restart.
+var restartFields = []string{
+	"BotToken", "DataFile", "WorkerCount", "WorkerQueueSize", "QueueFullPolicy",
+	"HTTPProxyURL", "HTTPMaxRetries", "PrefetchSize", "PrefetchInterval", "AdminChatID",
+}
+
+// Holder hands out the current config and swaps it atomically on reload,
+// so readers always see one complete config.
+type Holder struct {
+	mu  sync.Mutex // serializes reloads
+	cur atomic.Pointer[Config]
+}
+
+func NewHolder(c *Config) *Holder {
+	h := &Holder{}
+	h.cur.Store(c)
+	return h
+}
+
+// Get returns the current config. Callers should not keep it across
+// requests, or they will miss reloads.
+func (h *Holder) Get() *Config {
+	return h.cur.Load()
+}
+
+// Reload loads the config again and swaps it in if it is valid. It returns
+// the changed keys; on error the old config stays in place.
+func (h *Holder) Reload() ([]string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	next, err := Load()
+	if err != nil {
+		log.Printf("Config reload rejected, keeping the old config:\n%v", err)
+		return nil, err
+	}
+	changes := Diff(h.Get(), next)
+	h.cur.Store(next)
+
+	if len(changes) == 0 {
+		log.Println("Config reloaded, nothing changed")
+	}
+	for _, change := range changes {
+		log.Printf("Config reloaded: %s", change)
+	}
+	return changes, nil
+}
+
+// Watch reloads on SIGHUP and whenever the config file's modification time
+// changes, checking every interval. It never returns.
+func (h *Holder) Watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := modTime(FilePath())
+	for {
+		select {
+		case <-hup:
+			log.Println("SIGHUP received, reloading config")
+			h.Reload()
+			last = modTime(FilePath())
+		case <-ticker.C:
+			mod := modTime(FilePath())
+			if mod.Equal(last) {
+				continue
+			}
+			last = mod
+			log.Println("Config file changed, reloading config")
+			h.Reload()
+		}
+	}
+}
+
+func modTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// Diff lists the fields that differ between old and next as
+// "Field: old -> new". Fields tagged secret only report that they
+// changed, and passwords in URLs are masked.
+func Diff(old, next *Config) []string {
+	var out []string
+	a, b := reflect.ValueOf(old).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		name := field.Name
+		x, y := a.Field(i).Interface(), b.Field(i).Interface()
+		if reflect.DeepEqual(x, y) {
+			continue
+		}
+		change := fmt.Sprintf("%s: %v -> %v", name, redactURL(x), redactURL(y))
+		if field.Tag.Get("secret") == "true" {
+			change = name + ": changed"
+		}
+		if slices.Contains(restartFields, name) {
+			change += " (needs a restart)"
+		}
+		out = append(out, change)
+	}
+	return out
+}
+
+// redactURL masks the password of v when it is a URL with credentials.
+func redactURL(v any) any {
+	if s, ok := v.(string); ok {
+		if u, err := url.Parse(s); err == nil && u.User != nil {
+			return u.Redacted()
+		}
+	}
+	return v
+}
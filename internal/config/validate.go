@@ -0,0 +1,142 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"text/template"
+
+	"yume-go/internal/httpx"
+)
+
+// Validate checks the whole config and reports every problem at once.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	if c.BotToken == "" {
+		fail("telegram token is required (TELEGRAM_BOT_TOKEN)")
+	}
+
+	priority := []string{c.APIPrimary, c.APISecondary, c.APITertiary}
+	for i, name := range priority {
+		if name != "" && !slices.Contains(Providers, name) {
+			fail("provider priority: unknown provider %q (known: %v)", name, Providers)
+		}
+		if name != "" && slices.Contains(priority[:i], name) {
+			fail("provider priority: %q is listed more than once", name)
+		}
+	}
+	if c.APIPrimary == "" && c.APISecondary == "" && c.APITertiary == "" {
+		fail("provider priority: at least one provider is required")
+	}
+	total := 0
+	for name, w := range c.Weights {
+		if !slices.Contains(Providers, name) {
+			fail("provider weights: unknown provider %q (known: %v)", name, Providers)
+		}
+		if w < 0 {
+			fail("provider weights: %s has negative weight %d", name, w)
+		}
+		total += w
+	}
+	if len(c.Weights) > 0 && total == 0 {
+		fail("provider weights: at least one weight must be positive")
+	}
+	for name, raw := range map[string]string{
+		"waifu.im":   c.WaifuImURL,
+		"waifu.pics": c.WaifuPicsURL,
+		"waifu.it":   c.WaifuItURL,
+	} {
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("provider url for %s: %q is not an http(s) URL", name, raw)
+		}
+	}
+
+	if c.DataFile == "" {
+		fail("storage data file is required")
+	}
+
+	if c.WorkerCount <= 0 {
+		fail("workers count must be positive, got %d", c.WorkerCount)
+	}
+	if c.WorkerQueueSize <= 0 {
+		fail("workers queue size must be positive, got %d", c.WorkerQueueSize)
+	}
+	if c.QueueFullPolicy != "reject" && c.QueueFullPolicy != "block" {
+		fail("workers queue full policy must be reject or block, got %q", c.QueueFullPolicy)
+	}
+
+	if c.DownloadMemoryLimit <= 0 {
+		fail("download memory limit must be positive")
+	}
+	if c.DownloadMaxSize <= 0 {
+		fail("download max size must be positive")
+	}
+	if c.DownloadTimeout <= 0 {
+		fail("download timeout must be positive, got %s", c.DownloadTimeout)
+	}
+	for host, d := range c.DownloadHostTimeouts {
+		if host == "" || d <= 0 {
+			fail("download host timeout %q: %s is not a positive duration", host, d)
+		}
+	}
+	if c.DownloadRetries < 0 {
+		fail("download retries must not be negative, got %d", c.DownloadRetries)
+	}
+
+	if c.HTTPProxyURL != "" {
+		u, err := url.Parse(c.HTTPProxyURL)
+		if err != nil || !slices.Contains(httpx.ProxySchemes, u.Scheme) {
+			fail("http proxy url %q must use one of the schemes %v", c.HTTPProxyURL, httpx.ProxySchemes)
+		}
+	}
+	if c.HTTPMaxRetries < 0 {
+		fail("http max retries must not be negative, got %d", c.HTTPMaxRetries)
+	}
+
+	if c.PrefetchSize < 0 {
+		fail("prefetch size must not be negative, got %d", c.PrefetchSize)
+	}
+	if c.PrefetchInterval <= 0 {
+		fail("prefetch interval must be positive, got %s", c.PrefetchInterval)
+	}
+
+	if c.DuplicateDistance < 0 || c.DuplicateDistance > 64 {
+		fail("duplicate distance must be between 0 and 64, got %d", c.DuplicateDistance)
+	}
+	if c.RecentWindow < 0 {
+		fail("recent window must not be negative, got %d", c.RecentWindow)
+	}
+	if c.RerollLimit < 0 {
+		fail("reroll limit must not be negative, got %d", c.RerollLimit)
+	}
+
+	if c.CaptionTemplate != "" {
+		if _, err := template.New("caption").Funcs(CaptionFuncs).Parse(c.CaptionTemplate); err != nil {
+			fail("caption template: %v", err)
+		}
+	}
+
+	if len(c.Rarities) == 0 {
+		fail("rarity table: at least one tier is required")
+	}
+	seen := map[string]bool{}
+	for _, r := range c.Rarities {
+		if r.Name == "" {
+			fail("rarity table: tier without a name")
+		}
+		if seen[r.Name] {
+			fail("rarity table: duplicate tier %q", r.Name)
+		}
+		seen[r.Name] = true
+		if r.Weight <= 0 {
+			fail("rarity table: tier %q needs a positive weight, got %d", r.Name, r.Weight)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"yume-go/internal/api"
+	"yume-go/internal/config"
+	"yume-go/internal/i18n"
+	"yume-go/internal/storage"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// maxMessageLen keeps replies under Telegram's 4096 character limit.
+const maxMessageLen = 4000
+
+// RuntimeStats is what the router knows about itself for /admin stats.
+type RuntimeStats struct {
+	Uptime     time.Duration
+	Workers    int
+	QueueDepth int64
+	Prefetched int
+}
+
+// WithSourceOverrides returns cfg with the /admin source overrides from
+// settings applied. cfg itself is left untouched.
+func WithSourceOverrides(cfg *config.Config, settings storage.Settings) *config.Config {
+	if len(settings.SourceWeights) == 0 && len(settings.DisabledSources) == 0 {
+		return cfg
+	}
+	out := *cfg
+	out.Weights = maps.Clone(cfg.Weights)
+	if out.Weights == nil {
+		out.Weights = map[string]int{}
+	}
+	maps.Copy(out.Weights, settings.SourceWeights)
+
+	disabled := func(name string) bool { return slices.Contains(settings.DisabledSources, name) }
+	for _, name := range settings.DisabledSources {
+		delete(out.Weights, name)
+	}
+	for _, p := range []*string{&out.APIPrimary, &out.APISecondary, &out.APITertiary} {
+		if disabled(*p) {
+			*p = ""
+		}
+	}
+	return &out
+}
+
+func HandleAdminStats(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, apiClient *api.APIClient, store *storage.Store, rt RuntimeStats) {
+	lang := langOf(store, msg)
+	counts := store.Counts()
+
+	var sb strings.Builder
+	sb.WriteString(i18n.T(lang, "admin.stats.header") + "\n\n")
+	sb.WriteString(i18n.T(lang, "admin.stats.uptime", rt.Uptime.Round(time.Second)) + "\n")
+	sb.WriteString(i18n.T(lang, "admin.stats.queue", rt.QueueDepth, rt.Workers) + "\n")
+	sb.WriteString(i18n.N(lang, "admin.stats.prefetched", rt.Prefetched) + "\n")
+	sb.WriteString(i18n.N(lang, "admin.stats.users", counts.Users, counts.AnuUsers) + "\n")
+	sb.WriteString(i18n.N(lang, "admin.stats.chats", counts.Chats, counts.Groups) + "\n")
+	sb.WriteString(i18n.N(lang, "admin.stats.images", counts.Images) + "\n")
+
+	sb.WriteString("\n" + i18n.T(lang, "admin.stats.providers") + "\n")
+	stats := apiClient.Stats()
+	if len(stats) == 0 {
+		sb.WriteString(i18n.T(lang, "admin.stats.no_calls") + "\n")
+	}
+	for _, s := range stats {
+		sb.WriteString(i18n.T(lang, "admin.stats.provider",
+			s.Name, s.SuccessRate()*100, s.Successes, s.Successes+s.Failures, s.AvgLatency().Round(time.Millisecond)) + "\n")
+	}
+
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, sb.String()))
+}
+
+// HandleAdminReload reloads the config and reports the changed keys.
+func HandleAdminReload(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, store *storage.Store, holder *config.Holder) {
+	lang := langOf(store, msg)
+	log.Printf("Admin %d requested a config reload", msg.From.ID)
+
+	changes, err := holder.Reload()
+	var text string
+	switch {
+	case err != nil:
+		text = i18n.T(lang, "admin.reload.failed", err)
+	case len(changes) == 0:
+		text = i18n.T(lang, "admin.reload.unchanged")
+	default:
+		text = i18n.N(lang, "admin.reload.done", len(changes), strings.Join(changes, "\n"))
+	}
+	if len(text) > maxMessageLen {
+		text = strings.ToValidUTF8(text[:maxMessageLen], "") + "…"
+	}
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text))
+}
+
+// HandleAdminSource lists the providers, or turns one on or off or changes
+// its weight. cfg is the config as loaded, without overrides.
+func HandleAdminSource(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, store *storage.Store, cfg *config.Config, name, action string, weight int) {
+	lang := langOf(store, msg)
+
+	if name != "" && action != "" {
+		err := store.UpdateSettings(func(s *storage.Settings) {
+			switch action {
+			case "on":
+				s.DisabledSources = slices.DeleteFunc(slices.Clone(s.DisabledSources), func(n string) bool { return n == name })
+			case "off":
+				if !slices.Contains(s.DisabledSources, name) {
+					s.DisabledSources = append(slices.Clone(s.DisabledSources), name)
+				}
+			case "weight":
+				w := maps.Clone(s.SourceWeights)
+				if w == nil {
+					w = map[string]int{}
+				}
+				w[name] = weight
+				s.SourceWeights = w
+			case "reset":
+				w := maps.Clone(s.SourceWeights)
+				delete(w, name)
+				s.SourceWeights = w
+				s.DisabledSources = slices.DeleteFunc(slices.Clone(s.DisabledSources), func(n string) bool { return n == name })
+			}
+		})
+		if err != nil {
+			log.Printf("Error saving source override: %v", err)
+			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "admin.source.save_failed")))
+			return
+		}
+		log.Printf("Admin %d set source %s %s %d", msg.From.ID, name, action, weight)
+	}
+
+	settings := store.Settings()
+	effective := WithSourceOverrides(cfg, settings)
+	var sb strings.Builder
+	sb.WriteString(i18n.T(lang, "admin.source.header") + "\n\n")
+	for _, p := range config.Providers {
+		if name != "" && p != name {
+			continue
+		}
+		state := i18n.T(lang, "admin.source.enabled")
+		if slices.Contains(settings.DisabledSources, p) {
+			state = i18n.T(lang, "admin.source.disabled")
+		}
+		line := i18n.T(lang, "admin.source.line", p, state, effective.Weights[p])
+		if _, ok := settings.SourceWeights[p]; ok {
+			line += " " + i18n.T(lang, "admin.source.overridden", cfg.Weights[p])
+		}
+		sb.WriteString(line + "\n")
+	}
+	fmt.Fprintf(&sb, "\n%s", i18n.T(lang, "admin.source.priority",
+		strings.Join(nonEmpty(effective.APIPrimary, effective.APISecondary, effective.APITertiary), " → ")))
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, sb.String()))
+}
+
+func nonEmpty(vals ...string) []string {
+	var out []string
+	for _, v := range vals {
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
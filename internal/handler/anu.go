@@ -1,38 +1,117 @@
 package handler
 
 import (
-	"strings"
+	"log"
+	"time"
+
+	"yume-go/internal/config"
+	"yume-go/internal/i18n"
+	"yume-go/internal/storage"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
-var anuUserPref = struct {
-	m map[int64]bool
-}{m: make(map[int64]bool)}
+func HandleAnuSet(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, store *storage.Store, cfg *config.Config, enabled bool) {
+	lang := langOf(store, msg)
+	if enabled && isForcedSFW(cfg, store) {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "anu.disabled")))
+		return
+	}
 
-func HandleAnuToggleUser(bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
-	userID := msg.From.ID
-	args := strings.TrimSpace(msg.CommandArguments())
+	if enabled && store.User(msg.From.ID).ConsentAt.IsZero() {
+		prompt := tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "anu.consent"))
+		prompt.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "anu.confirm_button"), "anu:confirm"),
+				tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "anu.cancel_button"), "anu:cancel"),
+			),
+		)
+		bot.Send(prompt)
+		return
+	}
 
-	if args == "status" {
-		if anuUserPref.m[userID] {
-			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "🤨"))
-		} else {
-			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "😇"))
-		}
+	err := store.UpdateUser(msg.From.ID, func(u *storage.User) {
+		u.Anu = enabled
+	})
+	if err != nil {
+		log.Printf("Error saving anu preference: %v", err)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "anu.save_failed")))
 		return
 	}
+	sendAnuState(bot, msg.Chat.ID, enabled)
+}
 
-	cur := anuUserPref.m[userID]
-	anuUserPref.m[userID] = !cur
+// HandleAnuConsent answers the Confirm/Cancel buttons of the consent prompt.
+func HandleAnuConsent(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, store *storage.Store, cfg *config.Config, accepted bool) {
+	bot.Request(tgbotapi.NewCallback(query.ID, ""))
 
-	if anuUserPref.m[userID] {
-		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "🤨"))
+	lang := Lang(store, query.Message.Chat, query.From)
+	chatID, messageID := query.Message.Chat.ID, query.Message.MessageID
+	if !accepted {
+		bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, i18n.T(lang, "anu.cancelled")))
+		return
+	}
+	if isForcedSFW(cfg, store) {
+		bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, i18n.T(lang, "anu.disabled")))
+		return
+	}
+
+	err := store.UpdateUser(query.From.ID, func(u *storage.User) {
+		u.ConsentAt = time.Now()
+		u.Anu = true
+	})
+	if err != nil {
+		log.Printf("Error saving anu consent: %v", err)
+		bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, i18n.T(lang, "anu.save_failed")))
+		return
+	}
+
+	log.Printf("User %d confirmed anu consent", query.From.ID)
+	bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, i18n.T(lang, "anu.confirmed")))
+}
+
+func HandleAnuStatus(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, store *storage.Store) {
+	sendAnuState(bot, msg.Chat.ID, IsUserAnuEnabled(store, msg.From.ID))
+}
+
+// HandleForceSFW shows or flips the global kill switch. The switch set in
+// config cannot be turned off from chat.
+func HandleForceSFW(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, store *storage.Store, cfg *config.Config, state string) {
+	lang := langOf(store, msg)
+	if state != "" {
+		err := store.UpdateSettings(func(s *storage.Settings) {
+			s.ForceSFW = state == "on"
+		})
+		if err != nil {
+			log.Printf("Error saving force SFW: %v", err)
+			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "forcesfw.save_failed")))
+			return
+		}
+		log.Printf("Admin %d set force SFW %s", msg.From.ID, state)
+	}
+
+	key := "forcesfw.off"
+	switch {
+	case cfg.ForceSFW:
+		key = "forcesfw.on_config"
+	case store.Settings().ForceSFW:
+		key = "forcesfw.on"
+	}
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, key)))
+}
+
+func sendAnuState(bot *tgbotapi.BotAPI, chatID int64, enabled bool) {
+	if enabled {
+		bot.Send(tgbotapi.NewMessage(chatID, "🤨"))
 	} else {
-		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "😇"))
+		bot.Send(tgbotapi.NewMessage(chatID, "😇"))
 	}
 }
 
-func IsUserAnuEnabled(uid int64) bool {
-	return anuUserPref.m[uid]
+func IsUserAnuEnabled(store *storage.Store, uid int64) bool {
+	return store.User(uid).Anu
+}
+
+func isForcedSFW(cfg *config.Config, store *storage.Store) bool {
+	return cfg.ForceSFW || store.Settings().ForceSFW
 }
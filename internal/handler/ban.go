@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"yume-go/internal/config"
+	"yume-go/internal/i18n"
+	"yume-go/internal/storage"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// HandleBan bans target in this chat, or everywhere when rest starts with
+// "global" or the command comes from a private chat. rest may go on with
+// a duration such as 30m, 12h or 7d and a free-form reason.
+func HandleBan(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, store *storage.Store, cfg *config.Config, target int64, rest string) {
+	lang := langOf(store, msg)
+	args := strings.Fields(rest)
+
+	global, ok := banScope(bot, msg, store, cfg, &args)
+	if !ok {
+		return
+	}
+	if cfg.IsAdmin(target) {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "ban.admin")))
+		return
+	}
+
+	ban := storage.Ban{UserID: target, By: msg.From.ID, At: time.Now()}
+	if !global {
+		ban.ChatID = msg.Chat.ID
+	}
+	if len(args) > 0 {
+		if d, ok := parseBanDuration(args[0]); ok {
+			ban.Until = ban.At.Add(d)
+			args = args[1:]
+		}
+	}
+	ban.Reason = strings.Join(args, " ")
+
+	if err := store.AddBan(ban); err != nil {
+		log.Printf("Error saving ban: %v", err)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "ban.save_failed")))
+		return
+	}
+	log.Printf("User %d banned user %d (chat %d, until %v): %s", ban.By, target, ban.ChatID, ban.Until, ban.Reason)
+
+	key := "ban.done_chat"
+	if global {
+		key = "ban.done_global"
+	}
+	text := i18n.T(lang, key, userLabel(store, target))
+	if !ban.Until.IsZero() {
+		text += "\n" + i18n.T(lang, "ban.until", ban.Until.UTC().Format("2006-01-02 15:04 MST"))
+	}
+	if ban.Reason != "" {
+		text += "\n" + i18n.T(lang, "ban.reason", ban.Reason)
+	}
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text))
+}
+
+// HandleUnban lifts target's ban in this chat, or the global one when
+// scope is "global" or the command comes from a private chat.
+func HandleUnban(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, store *storage.Store, cfg *config.Config, target int64, scope string) {
+	lang := langOf(store, msg)
+	args := strings.Fields(scope)
+
+	global, ok := banScope(bot, msg, store, cfg, &args)
+	if !ok {
+		return
+	}
+	var chatID int64
+	if !global {
+		chatID = msg.Chat.ID
+	}
+
+	lifted, err := store.LiftBan(target, chatID, msg.From.ID)
+	if err != nil {
+		log.Printf("Error saving unban: %v", err)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "ban.save_failed")))
+		return
+	}
+	if !lifted {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "unban.none", userLabel(store, target))))
+		return
+	}
+	log.Printf("User %d lifted the ban on user %d (chat %d)", msg.From.ID, target, chatID)
+
+	key := "unban.done_chat"
+	if global {
+		key = "unban.done_global"
+	}
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, key, userLabel(store, target))))
+}
+
+// banScope consumes a leading "global" from args and checks that the
+// sender may act in that scope, replying if not. Global bans are for bot
+// admins; chat bans also for the chat's administrators.
+func banScope(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, store *storage.Store, cfg *config.Config, args *[]string) (global, ok bool) {
+	lang := langOf(store, msg)
+	if len(*args) > 0 && strings.EqualFold((*args)[0], "global") {
+		global = true
+		*args = (*args)[1:]
+	}
+	if msg.Chat.IsPrivate() {
+		global = true
+	}
+
+	isBotAdmin := msg.From != nil && cfg.IsAdmin(msg.From.ID)
+	switch {
+	case global && !isBotAdmin:
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "ban.global_admin_only")))
+		return false, false
+	case !global && !isBotAdmin && !isChatAdmin(bot, msg):
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "ban.admin_only")))
+		return false, false
+	}
+	return global, true
+}
+
+// parseBanDuration accepts Go durations plus d (days) and w (weeks).
+// Durations that do not fit in a time.Duration are rejected.
+func parseBanDuration(s string) (time.Duration, bool) {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+	if unit != 0 {
+		n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		if err != nil || n <= 0 || n > math.MaxInt64/int64(unit) {
+			return 0, false
+		}
+		return time.Duration(n) * unit, true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+func userLabel(store *storage.Store, id int64) string {
+	if name := store.User(id).Username; name != "" {
+		return "@" + name
+	}
+	return strconv.FormatInt(id, 10)
+}
@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBanDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"30m", 30 * time.Minute, true},
+		{"12h", 12 * time.Hour, true},
+		{"7d", 7 * 24 * time.Hour, true},
+		{"2w", 14 * 24 * time.Hour, true},
+		{"106751d", 106751 * 24 * time.Hour, true},
+		{"106752d", 0, false},
+		{"99999999999d", 0, false},
+		{"99999999999w", 0, false},
+		{"99999999999999999999d", 0, false},
+		{"0d", 0, false},
+		{"-1d", 0, false},
+		{"-5m", 0, false},
+		{"d", 0, false},
+		{"spam", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseBanDuration(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseBanDuration(%q) = %s, %t; want %s, %t", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
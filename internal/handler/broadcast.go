@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"yume-go/internal/i18n"
+	"yume-go/internal/storage"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// broadcastInterval keeps broadcasts under Telegram's limit of about
+	// 30 messages per second across all chats.
+	broadcastInterval = 40 * time.Millisecond
+	// broadcastProgressEvery is how often the preview shows progress.
+	broadcastProgressEvery = 3 * time.Second
+	// broadcastTTL is how long a preview can still be confirmed.
+	broadcastTTL = 15 * time.Minute
+	// maxBroadcastLen is Telegram's 4096 character message limit, less
+	// room for the preview header.
+	maxBroadcastLen = 4096 - 128
+)
+
+type pendingBroadcast struct {
+	text    string
+	adminID int64
+	created time.Time
+}
+
+var (
+	broadcastsMu sync.Mutex
+	broadcasts   = map[string]pendingBroadcast{}
+	// broadcasting guards against two broadcasts running at once.
+	broadcasting bool
+)
+
+// HandleBroadcast shows a preview of text with Send and Cancel buttons.
+// Nothing goes out until the same admin confirms.
+func HandleBroadcast(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, store *storage.Store, text string) {
+	lang := langOf(store, msg)
+
+	// Telegram counts message length in UTF-16 code units.
+	if n := len(utf16.Encode([]rune(text))); n > maxBroadcastLen {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "broadcast.too_long", n, maxBroadcastLen)))
+		return
+	}
+
+	var b [6]byte
+	rand.Read(b[:])
+	id := hex.EncodeToString(b[:])
+
+	broadcastsMu.Lock()
+	for k, p := range broadcasts {
+		if time.Since(p.created) > broadcastTTL {
+			delete(broadcasts, k)
+		}
+	}
+	broadcasts[id] = pendingBroadcast{text: text, adminID: msg.From.ID, created: time.Now()}
+	broadcastsMu.Unlock()
+
+	targets := len(store.BroadcastTargets())
+	preview := tgbotapi.NewMessage(msg.Chat.ID, i18n.N(lang, "broadcast.preview", targets, text))
+	preview.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "broadcast.send_button"), "bc:send:"+id),
+			tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "broadcast.cancel_button"), "bc:cancel:"+id),
+		),
+	)
+	bot.Send(preview)
+}
+
+// HandleBroadcastConfirm answers the preview buttons. Sending runs in the
+// background and edits the preview with progress and the final counts.
+func HandleBroadcastConfirm(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, store *storage.Store, id string, confirmed bool) {
+	lang := Lang(store, query.Message.Chat, query.From)
+	chatID, messageID := query.Message.Chat.ID, query.Message.MessageID
+
+	broadcastsMu.Lock()
+	p, ok := broadcasts[id]
+	if ok && p.adminID != query.From.ID {
+		broadcastsMu.Unlock()
+		bot.Request(tgbotapi.NewCallback(query.ID, i18n.T(lang, "broadcast.not_yours")))
+		return
+	}
+	if !ok || time.Since(p.created) > broadcastTTL {
+		delete(broadcasts, id)
+		broadcastsMu.Unlock()
+		bot.Request(tgbotapi.NewCallback(query.ID, ""))
+		bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, i18n.T(lang, "broadcast.expired")))
+		return
+	}
+	if confirmed && broadcasting {
+		broadcastsMu.Unlock()
+		bot.Request(tgbotapi.NewCallback(query.ID, i18n.T(lang, "broadcast.busy")))
+		return
+	}
+	delete(broadcasts, id)
+	if confirmed {
+		broadcasting = true
+	}
+	broadcastsMu.Unlock()
+
+	bot.Request(tgbotapi.NewCallback(query.ID, ""))
+	if !confirmed {
+		bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, i18n.T(lang, "broadcast.cancelled")))
+		return
+	}
+
+	log.Printf("Admin %d started a broadcast", query.From.ID)
+	go func() {
+		defer func() {
+			broadcastsMu.Lock()
+			broadcasting = false
+			broadcastsMu.Unlock()
+		}()
+		runBroadcast(bot, store, p.text, func(r broadcastResult, key string) {
+			text := i18n.T(lang, key, r.sent+r.blocked+r.failed, r.total, r.sent, r.blocked, r.failed)
+			bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, text))
+		})
+	}()
+}
+
+type broadcastResult struct {
+	total, sent, blocked, failed int
+}
+
+// runBroadcast sends text to every reachable chat at a steady rate, marking
+// chats that blocked the bot. report is called periodically with
+// "broadcast.progress" and once at the end with "broadcast.done", or with
+// "broadcast.aborted" and the partial counts if sending panics.
+func runBroadcast(bot *tgbotapi.BotAPI, store *storage.Store, text string, report func(r broadcastResult, key string)) {
+	targets := store.BroadcastTargets()
+	r := broadcastResult{total: len(targets)}
+
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Broadcast panicked after %d sent, %d blocked, %d failed of %d: %v\n%s",
+				r.sent, r.blocked, r.failed, r.total, p, debug.Stack())
+			report(r, "broadcast.aborted")
+		}
+	}()
+
+	ticker := time.NewTicker(broadcastInterval)
+	defer ticker.Stop()
+	lastReport := time.Now()
+
+	for _, chatID := range targets {
+		<-ticker.C
+		finalID, err := sendBroadcast(bot, store, chatID, text)
+		switch {
+		case err == nil:
+			r.sent++
+		case isBlocked(err):
+			r.blocked++
+			store.SetBlocked(finalID, true)
+		default:
+			r.failed++
+			log.Printf("Broadcast to chat %d failed: %v", chatID, err)
+		}
+		if time.Since(lastReport) >= broadcastProgressEvery {
+			lastReport = time.Now()
+			report(r, "broadcast.progress")
+		}
+	}
+
+	log.Printf("Broadcast finished: %d sent, %d blocked, %d failed of %d", r.sent, r.blocked, r.failed, r.total)
+	report(r, "broadcast.done")
+}
+
+// sendBroadcast sends one message, waiting out flood limits and following
+// groups that were upgraded to supergroups. Upgraded groups are moved to
+// their new ID in the store so later broadcasts go there directly. It
+// returns the ID the chat ended up under.
+func sendBroadcast(bot *tgbotapi.BotAPI, store *storage.Store, chatID int64, text string) (int64, error) {
+	for attempt := 0; ; attempt++ {
+		_, err := bot.Send(tgbotapi.NewMessage(chatID, text))
+		var tgErr *tgbotapi.Error
+		if err == nil || !errors.As(err, &tgErr) || attempt == 2 {
+			return chatID, err
+		}
+		switch {
+		case tgErr.RetryAfter > 0:
+			time.Sleep(time.Duration(tgErr.RetryAfter) * time.Second)
+		case tgErr.MigrateToChatID != 0:
+			log.Printf("Chat %d was upgraded to %d", chatID, tgErr.MigrateToChatID)
+			store.MigrateChat(chatID, tgErr.MigrateToChatID)
+			chatID = tgErr.MigrateToChatID
+		default:
+			return chatID, err
+		}
+	}
+}
+
+// isBlocked reports whether err means the chat can no longer be reached:
+// the user blocked the bot or was deleted, or the bot left the group.
+func isBlocked(err error) bool {
+	var tgErr *tgbotapi.Error
+	if !errors.As(err, &tgErr) {
+		return false
+	}
+	if tgErr.Code == 403 {
+		return true
+	}
+	msg := strings.ToLower(tgErr.Message)
+	return tgErr.Code == 400 && (strings.Contains(msg, "chat not found") || strings.Contains(msg, "user is deactivated"))
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+
+	"yume-go/internal/api"
+	"yume-go/internal/config"
+	"yume-go/internal/i18n"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// maxCaptionTags keeps long tag lists from pushing the caption over
+// Telegram's 1024 character limit.
+const (
+	maxCaptionTags = 6
+	maxCaptionLen  = 1024
+)
+
+// captionData is what caption templates see. Every string is escaped for
+// Telegram HTML, so templates may add their own tags around them.
+type captionData struct {
+	Character   string
+	ID          string
+	Name        string
+	Origin      string
+	Artist      string
+	Source      string
+	PageURL     string
+	Rarity      string
+	RarityEmoji string
+	Tags        []string
+}
+
+var (
+	captionMu    sync.Mutex
+	captionCache = map[string]*template.Template{}
+)
+
+// captionTemplate parses text once and caches it, so a config reload only
+// pays for templates that changed.
+func captionTemplate(text string) (*template.Template, error) {
+	captionMu.Lock()
+	defer captionMu.Unlock()
+	if t, ok := captionCache[text]; ok {
+		return t, nil
+	}
+	t, err := template.New("caption").Funcs(config.CaptionFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	captionCache[text] = t
+	return t, nil
+}
+
+func characterName(waifu *api.Waifu, lang string) string {
+	switch {
+	case waifu.Character != "":
+		return waifu.Character
+	case waifu.Name != "":
+		return waifu.Name
+	case len(waifu.Tags) > 0:
+		return waifu.Tags[0]
+	}
+	return i18n.T(lang, "caption.unknown")
+}
+
+func newCaptionData(waifu *api.Waifu, cfg *config.Config, lang string) captionData {
+	d := captionData{
+		Character: escapeHTML(characterName(waifu, lang)),
+		ID:        escapeHTML(waifu.ImageID),
+		Name:      escapeHTML(waifu.Name),
+		Origin:    escapeHTML(waifu.Origin),
+		Artist:    escapeHTML(waifu.Artist),
+		Source:    escapeHTML(waifu.Source),
+		PageURL:   escapeHTML(waifu.PageURL),
+	}
+	if r := rarityOf(waifu, cfg); r.Name != "" {
+		d.Rarity = escapeHTML(r.Name)
+		d.RarityEmoji = escapeHTML(r.Emoji)
+	}
+	for i, tag := range waifu.Tags {
+		if i == maxCaptionTags {
+			break
+		}
+		tag = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '-' {
+				return '_'
+			}
+			return r
+		}, tag)
+		d.Tags = append(d.Tags, "#"+escapeHTML(tag))
+	}
+	return d
+}
+
+func rarityOf(waifu *api.Waifu, cfg *config.Config) config.Rarity {
+	return api.RarityFor(waifu.ImageID, cfg.Rarities)
+}
+
+// buildCaption renders the configured caption template, or the
+// language's own "caption.template" when none is configured. Fields are
+// HTML-escaped; see captionData. It falls back to the plain caption if the
+// template is broken or renders too long.
+func buildCaption(waifu *api.Waifu, cfg *config.Config, lang string) string {
+	text := cfg.CaptionTemplate
+	if text == "" {
+		text = i18n.T(lang, "caption.template")
+	}
+	t, err := captionTemplate(text)
+	if err != nil {
+		log.Printf("Caption template: %v", err)
+		return buildCaptionSimple(waifu, lang)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, newCaptionData(waifu, cfg, lang)); err != nil {
+		log.Printf("Caption template: %v", err)
+		return buildCaptionSimple(waifu, lang)
+	}
+	caption := strings.TrimSpace(buf.String())
+	if len([]rune(caption)) > maxCaptionLen {
+		return buildCaptionSimple(waifu, lang)
+	}
+	return caption
+}
+
+// linkButtons returns a row of URL buttons for the artwork page and the
+// artist profile, or nil when the provider gave neither.
+func linkButtons(waifu *api.Waifu, lang string) []tgbotapi.InlineKeyboardButton {
+	var row []tgbotapi.InlineKeyboardButton
+	if isWebURL(waifu.PageURL) {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonURL(i18n.T(lang, "caption.source"), waifu.PageURL))
+	}
+	if isWebURL(waifu.ArtistURL) {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonURL(i18n.T(lang, "caption.artist"), waifu.ArtistURL))
+	}
+	return row
+}
+
+func isWebURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
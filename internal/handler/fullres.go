@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"yume-go/internal/api"
+	"yume-go/internal/config"
+	"yume-go/internal/i18n"
+	"yume-go/internal/media"
+	"yume-go/internal/util"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	originalTTL      = 6 * time.Hour
+	maxOriginalLinks = 1000
+)
+
+// originals maps image IDs of downscaled photos to their source URL so the
+// "Full resolution" button can fetch the untouched file again later.
+var originals = struct {
+	sync.Mutex
+	m map[string]originalLink
+}{m: make(map[string]originalLink)}
+
+type originalLink struct {
+	url     string
+	expires time.Time
+}
+
+func rememberOriginal(imageID, url string) {
+	originals.Lock()
+	defer originals.Unlock()
+
+	now := time.Now()
+	if len(originals.m) >= maxOriginalLinks {
+		for id, link := range originals.m {
+			if now.After(link.expires) {
+				delete(originals.m, id)
+			}
+		}
+	}
+	if len(originals.m) >= maxOriginalLinks {
+		return
+	}
+	originals.m[imageID] = originalLink{url: url, expires: now.Add(originalTTL)}
+}
+
+func lookupOriginal(imageID string) (string, bool) {
+	originals.Lock()
+	defer originals.Unlock()
+	link, ok := originals.m[imageID]
+	if !ok || time.Now().After(link.expires) {
+		return "", false
+	}
+	return link.url, true
+}
+
+// fullResolutionRow builds the button under a downscaled photo. The
+// spoiler flag rides along so the original gets the same warning.
+func fullResolutionRow(imageID string, spoiler bool, lang string) []tgbotapi.InlineKeyboardButton {
+	data := "full:" + imageID
+	if spoiler {
+		data += ":spoiler"
+	}
+	return tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(i18n.T(lang, "full.button"), data),
+	)
+}
+
+// HandleFullResolution sends the original file behind a downscaled photo
+// as a document.
+func HandleFullResolution(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, apiClient *api.APIClient, cfg *config.Config, imageID string, spoiler bool, lang string) {
+	url, ok := lookupOriginal(imageID)
+	if !ok {
+		bot.Request(tgbotapi.NewCallback(query.ID, i18n.T(lang, "full.expired")))
+		return
+	}
+	bot.Request(tgbotapi.NewCallback(query.ID, i18n.T(lang, "full.sending")))
+
+	chatID := query.Message.Chat.ID
+	bot.Send(tgbotapi.NewChatAction(chatID, tgbotapi.ChatUploadDocument))
+
+	result, err := util.Download(url, imageID, downloadOptions(cfg, apiClient))
+	if err != nil {
+		log.Printf("Full resolution download failed: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, i18n.T(lang, "full.download_failed")))
+		return
+	}
+	defer result.Cleanup()
+
+	opts := media.Options{Spoiler: spoiler, Warning: i18n.T(lang, "gacha.spoiler_warning")}
+	if _, err := media.SendDocument(bot, chatID, media.File(result), opts); err != nil {
+		log.Printf("Error sending original: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, i18n.T(lang, "full.send_failed")))
+	}
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strings"
@@ -8,6 +9,10 @@ import (
 
 	"yume-go/internal/api"
 	"yume-go/internal/config"
+	"yume-go/internal/i18n"
+	"yume-go/internal/media"
+	"yume-go/internal/prefetch"
+	"yume-go/internal/storage"
 	"yume-go/internal/util"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -26,71 +31,159 @@ func escapeHTML(s string) string {
 	return r.Replace(s)
 }
 
-func buildCaptionSimple(waifu *api.Waifu) string {
-	char := waifu.Character
-	if char == "" {
-		if waifu.Name != "" {
-			char = waifu.Name
-		} else if len(waifu.Tags) > 0 {
-			char = waifu.Tags[0]
-		} else {
-			char = "Unknown"
-		}
-	}
-	charEsc := escapeHTML(char)
+func buildCaptionSimple(waifu *api.Waifu, lang string) string {
+	charEsc := escapeHTML(characterName(waifu, lang))
 	idEsc := escapeHTML(waifu.ImageID)
-	return fmt.Sprintf("✨ You got: <b>%s</b>\nID: %s", charEsc, idEsc)
+	return i18n.T(lang, "caption.simple", charEsc, idEsc)
 }
 
-func HandleGacha(bot *tgbotapi.BotAPI, message *tgbotapi.Message, apiClient *api.APIClient, cfg *config.Config) {
-	typing := tgbotapi.NewChatAction(message.Chat.ID, tgbotapi.ChatTyping)
-	bot.Send(typing)
+func downloadOptions(cfg *config.Config, apiClient *api.APIClient) util.DownloadOptions {
+	return util.DownloadOptions{
+		Client:       apiClient.HTTP(),
+		MemoryLimit:  cfg.DownloadMemoryLimit,
+		MaxSize:      cfg.DownloadMaxSize,
+		Timeout:      cfg.DownloadTimeout,
+		HostTimeouts: cfg.DownloadHostTimeouts,
+		Retries:      cfg.DownloadRetries,
+	}
+}
+
+var errDownload = errors.New("download failed")
 
+// FetchAndDownload is the slow path of a pull: ask the providers for a
+// waifu and download its image. seen, when set, lets the providers re-roll
+// images the user got recently. Download failures wrap errDownload.
+func FetchAndDownload(apiClient *api.APIClient, cfg *config.Config, nsfw bool, seen func(*api.Waifu) bool) (*api.Waifu, *util.DownloadResult, error) {
 	apiPriority := []string{cfg.APIPrimary, cfg.APISecondary, cfg.APITertiary}
 
-	isAnu := IsUserAnuEnabled(message.From.ID)
-	waifu, err := apiClient.FetchRandomWaifu(isAnu, apiPriority, cfg)
+	waifu, err := apiClient.FetchUnseenWaifu(nsfw, apiPriority, cfg, seen, cfg.RerollLimit)
 	if err != nil {
-		log.Printf("Error fetching waifu: %v", err)
-		msg := tgbotapi.NewMessage(message.Chat.ID, "Sorry, the gacha failed. Please try again!")
-		bot.Send(msg)
-		return
+		return nil, nil, err
 	}
-
 	log.Printf("Fetched waifu %s (ID: %s) from %s", waifu.Name, waifu.ImageID, waifu.Source)
 
-	uploadAction := tgbotapi.NewChatAction(message.Chat.ID, tgbotapi.ChatUploadPhoto)
-	bot.Send(uploadAction)
+	result, err := util.Download(waifu.URL, waifu.ImageID, downloadOptions(cfg, apiClient))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errDownload, err)
+	}
+	return waifu, result, nil
+}
+
+func HandleGacha(bot *tgbotapi.BotAPI, message *tgbotapi.Message, apiClient *api.APIClient, cfg *config.Config, store *storage.Store, prefetcher *prefetch.Prefetcher) {
+	typing := tgbotapi.NewChatAction(message.Chat.ID, tgbotapi.ChatTyping)
+	bot.Send(typing)
+
+	isAnu, spoiler := contentMode(cfg, store, message)
+	lang := langOf(store, message)
+
+	var userID int64
+	if message.From != nil {
+		userID = message.From.ID
+	}
+	seenByID := func(w *api.Waifu) bool {
+		return store.RecentlySeen(userID, storage.SeenImage{ID: w.ImageID}, cfg.DuplicateDistance)
+	}
+
+	// seen checks a downloaded image by ID and, when it has a hash, by
+	// similarity, so copies from other providers count too.
+	seen := func(w *api.Waifu, res *util.DownloadResult) bool {
+		img := storage.SeenImage{ID: w.ImageID, PHash: res.PHash, HasPHash: res.HasPHash}
+		if res.HasPHash {
+			img.ID = store.CanonicalImage(w.ImageID, res.PHash, cfg.DuplicateDistance)
+		}
+		return store.RecentlySeen(userID, img, cfg.DuplicateDistance)
+	}
+
+	// Prefetched items and fresh downloads share one re-roll budget.
+	// Prefetched items the user saw go back for other users once a pick
+	// is made, so the loop does not draw them again.
+	bucket := prefetch.Bucket{NSFW: isAnu}
+	var (
+		waifu   *api.Waifu
+		result  *util.DownloadResult
+		err     error
+		skipped []*prefetch.Item
+	)
+	for attempt := 0; ; attempt++ {
+		if item, ok := prefetcher.Get(bucket); ok {
+			waifu, result = item.Waifu, item.Result
+			if attempt >= cfg.RerollLimit || !seen(waifu, result) {
+				log.Printf("Using prefetched waifu %s (ID: %s) from %s", waifu.Name, waifu.ImageID, waifu.Source)
+				break
+			}
+			log.Printf("User %d saw prefetched %s recently, re-rolling (%d/%d)", userID, waifu.ImageID, attempt+1, cfg.RerollLimit)
+			skipped = append(skipped, item)
+			continue
+		}
 
-	result, err := util.DownloadToTemp(waifu.URL, waifu.ImageID)
+		uploadAction := tgbotapi.NewChatAction(message.Chat.ID, tgbotapi.ChatUploadPhoto)
+		bot.Send(uploadAction)
+		waifu, result, err = FetchAndDownload(apiClient, cfg, isAnu, seenByID)
+		if err != nil || attempt >= cfg.RerollLimit || !seen(waifu, result) {
+			break
+		}
+		log.Printf("User %d saw %s recently, re-rolling (%d/%d)", userID, waifu.ImageID, attempt+1, cfg.RerollLimit)
+		result.Cleanup()
+	}
+	for _, item := range skipped {
+		prefetcher.Put(bucket, item)
+	}
 	if err != nil {
-		log.Printf("Download failed: %v", err)
-		msg := tgbotapi.NewMessage(message.Chat.ID, "Sorry, failed to download image. Please try again!")
-		bot.Send(msg)
+		key := "gacha.failed"
+		if errors.Is(err, errDownload) {
+			key = "gacha.download_failed"
+		}
+		log.Printf("Gacha failed: %v", err)
+		bot.Send(tgbotapi.NewMessage(message.Chat.ID, i18n.T(lang, key)))
 		return
 	}
-	defer util.CleanupTemp(result.FolderPath)
+	defer result.Cleanup()
+
+	sourceID := waifu.ImageID
+	if result.HasPHash {
+		if canonical := store.CanonicalImage(waifu.ImageID, result.PHash, cfg.DuplicateDistance); canonical != waifu.ImageID {
+			log.Printf("Image %s from %s is a duplicate of %s", waifu.ImageID, waifu.Source, canonical)
+			waifu.ImageID = canonical
+		}
+	}
 
-	caption := buildCaptionSimple(waifu)
+	caption := buildCaption(waifu, cfg, lang)
+	var rows [][]tgbotapi.InlineKeyboardButton
+	if links := linkButtons(waifu, lang); links != nil {
+		rows = append(rows, links)
+	}
 
-	sendDone := make(chan error, 1)
+	opts := media.Options{
+		Caption:   caption,
+		ParseMode: "HTML",
+		Spoiler:   spoiler,
+		Warning:   i18n.T(lang, "gacha.spoiler_warning"),
+	}
 
-	go func() {
-		var err error
-
-		if result.FileSize > 10*1024*1024 {
-			log.Printf("File size %d bytes, sending as document", result.FileSize)
-			doc := tgbotapi.NewDocument(message.Chat.ID, tgbotapi.FilePath(result.FilePath))
-			doc.Caption = caption
-			doc.ParseMode = "HTML"
-			_, err = bot.Send(doc)
+	// Resizing happens here rather than in the send goroutine, so it runs
+	// under the handler's panic recovery and not against the send timeout.
+	send := media.SendAnimation
+	file := media.File(result)
+	if !result.Animated {
+		photo, resized, prepErr := util.PreparePhoto(result)
+		if prepErr != nil {
+			log.Printf("Sending as document: %v", prepErr)
+			send = media.SendDocument
 		} else {
-			photo := tgbotapi.NewPhoto(message.Chat.ID, tgbotapi.FilePath(result.FilePath))
-			photo.Caption = caption
-			photo.ParseMode = "HTML"
-			_, err = bot.Send(photo)
+			if resized {
+				rememberOriginal(waifu.ImageID, waifu.URL)
+				rows = append(rows, fullResolutionRow(waifu.ImageID, spoiler, lang))
+			}
+			send, file = media.SendPhoto, media.File(photo)
 		}
+	}
+	if len(rows) > 0 {
+		opts.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	}
 
+	sendDone := make(chan error, 1)
+	go func() {
+		_, err := send(bot, message.Chat.ID, file, opts)
 		sendDone <- err
 	}()
 
@@ -98,16 +191,24 @@ func HandleGacha(bot *tgbotapi.BotAPI, message *tgbotapi.Message, apiClient *api
 	case err := <-sendDone:
 		if err != nil {
 			log.Printf("Error sending: %v", err)
-			msg := tgbotapi.NewMessage(message.Chat.ID, "Failed to send image. Please try again!")
+			msg := tgbotapi.NewMessage(message.Chat.ID, i18n.T(lang, "gacha.send_failed"))
 			bot.Send(msg)
 			return
 		}
 		log.Printf("Successfully sent waifu %s (ID: %s) to user %d",
-			waifu.Character, waifu.ImageID, message.From.ID)
+			waifu.Character, waifu.ImageID, userID)
+		if result.HasPHash {
+			store.RecordImage(sourceID, result.PHash, waifu.Source, cfg.DuplicateDistance)
+		}
+		store.MarkSeen(userID, storage.SeenImage{
+			ID:       waifu.ImageID,
+			PHash:    result.PHash,
+			HasPHash: result.HasPHash,
+		}, cfg.RecentWindow)
 
 	case <-time.After(60 * time.Second):
 		log.Printf("Send timeout for waifu %s (ID: %s)", waifu.Character, waifu.ImageID)
-		msg := tgbotapi.NewMessage(message.Chat.ID, "Upload timeout. Try again!")
+		msg := tgbotapi.NewMessage(message.Chat.ID, i18n.T(lang, "gacha.timeout"))
 		bot.Send(msg)
 		return
 	}
@@ -1,23 +1,25 @@
 package handler
 
 import (
+	"fmt"
 	"log"
+	"strings"
+
+	"yume-go/internal/i18n"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
-func HandleStart(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
+func HandleStart(bot *tgbotapi.BotAPI, message *tgbotapi.Message, lang string) {
 	typing := tgbotapi.NewChatAction(message.Chat.ID, tgbotapi.ChatTyping)
 	bot.Send(typing)
 
-	text := "Welcome to Yume-Go! 🌸\n\n" +
-		"A waifu gacha bot where you can get a random waifu.\n\n" +
-		"Type /help to see the list of available commands."
+	text := i18n.T(lang, "start.welcome")
 
 	buttons := tgbotapi.NewInlineKeyboardMarkup(
 		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonURL(" Developer", "https://t.me/pavellc"),
-			tgbotapi.NewInlineKeyboardButtonURL(" Source Code", "https://github.com/pavelc4/yume-go"),
+			tgbotapi.NewInlineKeyboardButtonURL(i18n.T(lang, "start.developer"), "https://t.me/pavellc"),
+			tgbotapi.NewInlineKeyboardButtonURL(i18n.T(lang, "start.source"), "https://github.com/pavelc4/yume-go"),
 		),
 	)
 
@@ -32,23 +34,54 @@ func HandleStart(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
 	}
 }
 
-func HandleHelp(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
+// CommandInfo is the part of a registered command that /help displays.
+type CommandInfo struct {
+	Name        string
+	Description string
+	Usage       string
+	Aliases     []string
+}
+
+func HandleHelp(bot *tgbotapi.BotAPI, message *tgbotapi.Message, commands []CommandInfo, topic, lang string) {
 	typing := tgbotapi.NewChatAction(message.Chat.ID, tgbotapi.ChatTyping)
 	bot.Send(typing)
 
-	text := "📖 Command List:\n\n" +
-		"/start - Start the bot\n" +
-		"/help - Show this help menu\n" +
-		"/gacha - Get a random waifu\n" +
-		"/anu - Toggle anu\n" +
-		"/profile - View your profile (coming soon)\n" +
-		"/collection - View your waifu collection (coming soon)"
+	var text string
+	if topic == "" {
+		var sb strings.Builder
+		sb.WriteString(i18n.T(lang, "help.header") + "\n\n")
+		for _, c := range commands {
+			fmt.Fprintf(&sb, "/%s - %s\n", c.Name, c.Description)
+		}
+		sb.WriteString("\n" + i18n.T(lang, "help.footer"))
+		text = sb.String()
+	} else {
+		text = i18n.T(lang, "help.unknown", topic)
+		for _, c := range commands {
+			if c.Name == topic {
+				text = commandDetails(c, lang)
+				break
+			}
+		}
+	}
 
 	msg := tgbotapi.NewMessage(message.Chat.ID, text)
 	_, err := bot.Send(msg)
 	if err != nil {
 		log.Printf("Error sending help message: %v", err)
 	} else {
-		log.Printf("Sent help message to user %d", message.From.ID)
+		log.Printf("Sent help message to chat %d", message.Chat.ID)
+	}
+}
+
+func commandDetails(c CommandInfo, lang string) string {
+	usage := c.Usage
+	if usage == "" {
+		usage = "/" + c.Name
+	}
+	text := fmt.Sprintf("/%s - %s\n\n%s", c.Name, c.Description, i18n.T(lang, "help.usage", usage))
+	if len(c.Aliases) > 0 {
+		text += "\n" + i18n.N(lang, "help.aliases", len(c.Aliases), "/"+strings.Join(c.Aliases, ", /"))
 	}
+	return text
 }
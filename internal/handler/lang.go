@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"log"
+	"strings"
+
+	"yume-go/internal/i18n"
+	"yume-go/internal/storage"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Lang picks the language to answer in. A language set on a group with
+// /lang wins, then the user's own choice, then their Telegram
+// language_code.
+func Lang(store *storage.Store, chat *tgbotapi.Chat, from *tgbotapi.User) string {
+	if chat != nil && !chat.IsPrivate() {
+		if lang := store.Chat(chat.ID).Lang; lang != "" {
+			return lang
+		}
+	}
+	if from != nil {
+		if lang := store.User(from.ID).Lang; lang != "" {
+			return lang
+		}
+		if lang := i18n.Match(from.LanguageCode); lang != "" {
+			return lang
+		}
+	}
+	return i18n.Default
+}
+
+func langOf(store *storage.Store, msg *tgbotapi.Message) string {
+	return Lang(store, msg.Chat, msg.From)
+}
+
+// HandleLang shows or changes the language. In groups it sets the chat
+// language and needs an administrator; "auto" clears the override.
+func HandleLang(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, store *storage.Store, code string) {
+	lang := langOf(store, msg)
+	if code == "" {
+		text := i18n.T(lang, "lang.current", i18n.Name(lang)) + "\n" +
+			i18n.T(lang, "lang.available", strings.Join(i18n.Supported(), ", "))
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text))
+		return
+	}
+
+	if code == "auto" {
+		code = ""
+	}
+	var err error
+	if msg.Chat.IsPrivate() {
+		err = store.UpdateUser(msg.From.ID, func(u *storage.User) {
+			u.Lang = code
+		})
+	} else {
+		if !isChatAdmin(bot, msg) {
+			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "lang.admin_only")))
+			return
+		}
+		err = store.UpdateChat(msg.Chat.ID, func(c *storage.Chat) {
+			c.Lang = code
+		})
+	}
+	if err != nil {
+		log.Printf("Error saving language: %v", err)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "lang.save_failed")))
+		return
+	}
+
+	lang = langOf(store, msg)
+	text := i18n.T(lang, "lang.set", i18n.Name(lang))
+	if code == "" {
+		text = i18n.T(lang, "lang.auto")
+	}
+	log.Printf("Chat %d language set to %q", msg.Chat.ID, code)
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text))
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"log"
+
+	"yume-go/internal/config"
+	"yume-go/internal/i18n"
+	"yume-go/internal/storage"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func HandlePolicy(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, store *storage.Store, policy string) {
+	lang := langOf(store, msg)
+	if policy == "" {
+		current := store.Chat(msg.Chat.ID).ContentPolicy()
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "policy.current", current)))
+		return
+	}
+
+	if !isChatAdmin(bot, msg) {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "policy.admin_only")))
+		return
+	}
+
+	err := store.UpdateChat(msg.Chat.ID, func(c *storage.Chat) {
+		c.Policy = policy
+	})
+	if err != nil {
+		log.Printf("Error saving chat policy: %v", err)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "policy.save_failed")))
+		return
+	}
+
+	log.Printf("Chat %d policy set to %s", msg.Chat.ID, policy)
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, i18n.T(lang, "policy.set", policy)))
+}
+
+// isChatAdmin asks Telegram whether the sender administers the chat.
+// Anonymous admins post on behalf of the chat itself and count as admins,
+// and everyone administers their own private chat.
+func isChatAdmin(bot *tgbotapi.BotAPI, msg *tgbotapi.Message) bool {
+	if msg.Chat.IsPrivate() {
+		return true
+	}
+	if msg.SenderChat != nil && msg.SenderChat.ID == msg.Chat.ID {
+		return true
+	}
+	if msg.From == nil {
+		return false
+	}
+
+	member, err := bot.GetChatMember(tgbotapi.GetChatMemberConfig{
+		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{
+			ChatID: msg.Chat.ID,
+			UserID: msg.From.ID,
+		},
+	})
+	if err != nil {
+		log.Printf("Error checking admin status in chat %d: %v", msg.Chat.ID, err)
+		return false
+	}
+	return member.IsCreator() || member.IsAdministrator()
+}
+
+// contentMode combines the sender's anu preference with the chat policy,
+// which always wins. spoiler is only ever set together with nsfw.
+func contentMode(cfg *config.Config, store *storage.Store, msg *tgbotapi.Message) (nsfw, spoiler bool) {
+	if isForcedSFW(cfg, store) {
+		return false, false
+	}
+	if msg.From == nil || !IsUserAnuEnabled(store, msg.From.ID) {
+		return false, false
+	}
+	switch store.Chat(msg.Chat.ID).ContentPolicy() {
+	case storage.PolicyAllowNSFW:
+		return true, false
+	case storage.PolicyNSFWSpoiler:
+		return true, true
+	default:
+		return false, false
+	}
+}
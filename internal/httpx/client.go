@@ -0,0 +1,187 @@
+// Package httpx builds the HTTP client shared by the API client and the
+// downloader: one pooled transport, retries with backoff and per-host
+// default headers.
+package httpx
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	baseBackoff = 500 * time.Millisecond
+	maxBackoff  = 30 * time.Second
+)
+
+// ProxySchemes are the proxy URL schemes NewClient accepts.
+var ProxySchemes = []string{"http", "https", "socks5", "socks5h"}
+
+type Options struct {
+	// ProxyURL may use any of ProxySchemes. When empty the usual
+	// HTTP_PROXY/HTTPS_PROXY environment variables apply.
+	ProxyURL   string
+	MaxRetries int
+}
+
+// hostProfiles holds default headers per host. A profile applies to the
+// host and its subdomains; headers the caller set explicitly win.
+var hostProfiles = map[string]http.Header{
+	"": {
+		"User-Agent": {"yume-go/1.0"},
+	},
+	// The image CDNs reject requests that don't look like a browser
+	// coming from their own site.
+	"cdn.waifu.im": {
+		"User-Agent": {"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36"},
+		"Referer":    {"https://waifu.im/"},
+	},
+	"i.waifu.pics": {
+		"User-Agent": {"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36"},
+		"Referer":    {"https://waifu.pics/"},
+	},
+}
+
+func NewClient(opts Options) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if opts.ProxyURL != "" {
+		u, err := url.Parse(opts.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		if !slices.Contains(ProxySchemes, u.Scheme) {
+			return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+		}
+		proxy = http.ProxyURL(u)
+		log.Printf("Using proxy %s://%s", u.Scheme, u.Host)
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 20 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: &retryTransport{
+			base:       transport,
+			maxRetries: opts.MaxRetries,
+		},
+	}, nil
+}
+
+// retryTransport retries idempotent requests that fail at the network
+// level or come back with 429/5xx, backing off exponentially and honouring
+// Retry-After. It gives up early rather than wait past the request's
+// deadline, so all retries fit inside the caller's timeout.
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = withProfile(req)
+	idempotent := (req.Method == http.MethodGet || req.Method == http.MethodHead) && req.Body == nil
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if !idempotent || attempt >= t.maxRetries || !shouldRetry(resp, err) {
+			return resp, err
+		}
+
+		wait := backoff(attempt)
+		if resp != nil {
+			if ra, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+				wait = min(ra, maxBackoff)
+			}
+		}
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < wait {
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+			log.Printf("[http] %s %s: status %d, retrying in %s", req.Method, req.URL.Host, resp.StatusCode, wait)
+		} else {
+			log.Printf("[http] %s %s: %v, retrying in %s", req.Method, req.URL.Host, err, wait)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+func backoff(attempt int) time.Duration {
+	d := baseBackoff << attempt
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	// Up to 25% jitter keeps parallel retries from lining up.
+	return d - time.Duration(rand.Int64N(int64(d/4)+1))
+}
+
+// retryAfter parses either delay-seconds or an HTTP date.
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// withProfile returns req with the host's default headers filled in.
+func withProfile(req *http.Request) *http.Request {
+	profile := hostProfiles[""]
+	host := strings.ToLower(req.URL.Hostname())
+	for h, p := range hostProfiles {
+		if h != "" && (host == h || strings.HasSuffix(host, "."+h)) {
+			profile = p
+			break
+		}
+	}
+
+	var out *http.Request
+	for key, values := range profile {
+		if req.Header.Get(key) != "" {
+			continue
+		}
+		if out == nil {
+			out = req.Clone(req.Context())
+		}
+		out.Header[key] = values
+	}
+	if out == nil {
+		return req
+	}
+	return out
+}
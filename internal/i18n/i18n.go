@@ -0,0 +1,143 @@
+// Package i18n holds the bot's message catalogs. Each language is a JSON
+// file under locales/ mapping keys to either a format string or, for
+// messages that depend on a count, an object of plural forms.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Default is the language used when nothing better is known, and the
+// fallback for keys missing from other catalogs.
+const Default = "en"
+
+//go:embed locales/*.json
+var files embed.FS
+
+// message holds the plural forms of one catalog entry. Plain strings are
+// stored as Other.
+type message struct {
+	One   string `json:"one"`
+	Other string `json:"other"`
+}
+
+func (m *message) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &m.Other)
+	}
+	type forms message
+	return json.Unmarshal(b, (*forms)(m))
+}
+
+var catalogs = load()
+
+func load() map[string]map[string]message {
+	out := map[string]map[string]message{}
+	entries, err := files.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range entries {
+		b, err := files.ReadFile(path.Join("locales", e.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var catalog map[string]message
+		if err := json.Unmarshal(b, &catalog); err != nil {
+			panic(fmt.Sprintf("i18n: %s: %v", e.Name(), err))
+		}
+		out[strings.TrimSuffix(e.Name(), ".json")] = catalog
+	}
+	return out
+}
+
+// pluralRules pick the form for a count. Languages without an entry, such
+// as Indonesian, use Other for every count.
+var pluralRules = map[string]func(n int) bool{
+	"en": func(n int) bool { return n == 1 },
+}
+
+// Supported lists the available language codes, sorted.
+func Supported() []string {
+	out := make([]string, 0, len(catalogs))
+	for lang := range catalogs {
+		out = append(out, lang)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Match maps a Telegram language_code such as "id" or "en-US" to a
+// supported language, or "" if there is none.
+func Match(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if i := strings.IndexAny(code, "-_"); i != -1 {
+		code = code[:i]
+	}
+	if _, ok := catalogs[code]; ok {
+		return code
+	}
+	return ""
+}
+
+// Name returns the language's own name for itself.
+func Name(lang string) string {
+	return T(lang, "lang.name")
+}
+
+func lookup(lang, key string) (message, bool) {
+	if m, ok := catalogs[lang][key]; ok {
+		return m, true
+	}
+	m, ok := catalogs[Default][key]
+	if !ok {
+		log.Printf("i18n: missing key %q", key)
+	}
+	return m, ok
+}
+
+// Has reports whether key exists in lang or the default catalog.
+func Has(lang, key string) bool {
+	if _, ok := catalogs[lang][key]; ok {
+		return true
+	}
+	_, ok := catalogs[Default][key]
+	return ok
+}
+
+// T formats the message key in lang with args. Unknown keys come back as
+// the key itself so they stand out.
+func T(lang, key string, args ...any) string {
+	m, ok := lookup(lang, key)
+	if !ok {
+		return key
+	}
+	return format(m.Other, args)
+}
+
+// N formats the plural form of key matching n. n is passed as the first
+// format argument, followed by args.
+func N(lang, key string, n int, args ...any) string {
+	m, ok := lookup(lang, key)
+	if !ok {
+		return key
+	}
+	text := m.Other
+	if rule := pluralRules[lang]; rule != nil && rule(n) && m.One != "" {
+		text = m.One
+	}
+	return format(text, append([]any{n}, args...))
+}
+
+func format(text string, args []any) string {
+	if len(args) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
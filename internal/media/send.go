@@ -0,0 +1,194 @@
+// Package media sends photos, animations, documents and albums with
+// options the bundled tgbotapi configs do not expose, such as has_spoiler.
+package media
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"yume-go/internal/util"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const SpoilerWarning = "⚠️ Sensitive content, tap to reveal."
+
+type Options struct {
+	Caption   string
+	ParseMode string
+	Spoiler   bool
+	// Warning replaces SpoilerWarning, e.g. with a translation.
+	Warning     string
+	ReplyMarkup interface{}
+}
+
+// Item is one entry of a media group. Kind is "photo", "document" or
+// "animation".
+type Item struct {
+	Kind      string
+	File      tgbotapi.RequestFileData
+	Caption   string
+	ParseMode string
+}
+
+func baseParams(chatID int64, opts Options) (tgbotapi.Params, error) {
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", chatID)
+	params.AddNonEmpty("caption", opts.Caption)
+	params.AddNonEmpty("parse_mode", opts.ParseMode)
+	if err := params.AddInterface("reply_markup", opts.ReplyMarkup); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+func send(bot *tgbotapi.BotAPI, endpoint, field string, params tgbotapi.Params, file tgbotapi.RequestFileData) (tgbotapi.Message, error) {
+	var msg tgbotapi.Message
+	resp, err := bot.UploadFiles(endpoint, params, []tgbotapi.RequestFile{{Name: field, Data: file}})
+	if err != nil {
+		return msg, err
+	}
+	err = json.Unmarshal(resp.Result, &msg)
+	return msg, err
+}
+
+// SendPhoto sends file as a photo. Spoiler blurs it behind has_spoiler and
+// adds the warning line to the caption.
+func SendPhoto(bot *tgbotapi.BotAPI, chatID int64, file tgbotapi.RequestFileData, opts Options) (tgbotapi.Message, error) {
+	if opts.Spoiler {
+		opts.Caption = warningCaption(opts.Warning, opts.Caption)
+	}
+	params, err := baseParams(chatID, opts)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	params.AddBool("has_spoiler", opts.Spoiler)
+	return send(bot, "sendPhoto", "photo", params, file)
+}
+
+// SendAnimation sends a GIF or animated WebP so it keeps playing. Spoiler
+// works the same way as for photos.
+func SendAnimation(bot *tgbotapi.BotAPI, chatID int64, file tgbotapi.RequestFileData, opts Options) (tgbotapi.Message, error) {
+	if opts.Spoiler {
+		opts.Caption = warningCaption(opts.Warning, opts.Caption)
+	}
+	params, err := baseParams(chatID, opts)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	params.AddBool("has_spoiler", opts.Spoiler)
+	return send(bot, "sendAnimation", "animation", params, file)
+}
+
+// SendDocument sends file as a document. Telegram cannot blur documents,
+// so Spoiler only adds the warning line to the caption.
+func SendDocument(bot *tgbotapi.BotAPI, chatID int64, file tgbotapi.RequestFileData, opts Options) (tgbotapi.Message, error) {
+	if opts.Spoiler {
+		opts.Caption = warningCaption(opts.Warning, opts.Caption)
+	}
+	params, err := baseParams(chatID, opts)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	return send(bot, "sendDocument", "document", params, file)
+}
+
+// SendMediaGroup sends up to ten items as an album. With spoiler set every
+// item gets the warning caption, warning or SpoilerWarning, and photos are
+// blurred as well. Telegram does not allow animations in albums, so those
+// follow as separate messages.
+func SendMediaGroup(bot *tgbotapi.BotAPI, chatID int64, items []Item, spoiler bool, warning string) ([]tgbotapi.Message, error) {
+	var album, animations []Item
+	for _, item := range items {
+		if item.Kind == "animation" {
+			animations = append(animations, item)
+		} else {
+			album = append(album, item)
+		}
+	}
+
+	var msgs []tgbotapi.Message
+	if len(album) > 0 {
+		params, files, err := albumParams(chatID, album, spoiler, warning)
+		if err != nil {
+			return msgs, err
+		}
+		resp, err := bot.UploadFiles("sendMediaGroup", params, files)
+		if err != nil {
+			return msgs, err
+		}
+		if err := json.Unmarshal(resp.Result, &msgs); err != nil {
+			return msgs, err
+		}
+	}
+	for _, item := range animations {
+		opts := Options{Caption: item.Caption, ParseMode: item.ParseMode, Spoiler: spoiler, Warning: warning}
+		sent, err := SendAnimation(bot, chatID, item.File, opts)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, sent)
+	}
+	return msgs, nil
+}
+
+// albumParams builds the sendMediaGroup request. Files that need an upload
+// are attached by name; the rest are sent by file ID or URL.
+func albumParams(chatID int64, items []Item, spoiler bool, warning string) (tgbotapi.Params, []tgbotapi.RequestFile, error) {
+	type inputMedia struct {
+		Type       string `json:"type"`
+		Media      string `json:"media"`
+		Caption    string `json:"caption,omitempty"`
+		ParseMode  string `json:"parse_mode,omitempty"`
+		HasSpoiler bool   `json:"has_spoiler,omitempty"`
+	}
+
+	media := make([]inputMedia, 0, len(items))
+	var files []tgbotapi.RequestFile
+	for i, item := range items {
+		m := inputMedia{
+			Type:      item.Kind,
+			Caption:   item.Caption,
+			ParseMode: item.ParseMode,
+		}
+		if spoiler {
+			m.Caption = warningCaption(warning, m.Caption)
+			m.HasSpoiler = item.Kind == "photo"
+		}
+		if item.File.NeedsUpload() {
+			name := fmt.Sprintf("file-%d", i)
+			m.Media = "attach://" + name
+			files = append(files, tgbotapi.RequestFile{Name: name, Data: item.File})
+		} else {
+			m.Media = item.File.SendData()
+		}
+		media = append(media, m)
+	}
+
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", chatID)
+	if err := params.AddInterface("media", media); err != nil {
+		return nil, nil, err
+	}
+	return params, files, nil
+}
+
+func warningCaption(warning, caption string) string {
+	if warning == "" {
+		warning = SpoilerWarning
+	}
+	if caption == "" {
+		return warning
+	}
+	return warning + "\n\n" + caption
+}
+
+// File turns a download into upload data, streaming from memory when the
+// download was small enough to stay there.
+func File(res *util.DownloadResult) tgbotapi.RequestFileData {
+	if res.InMemory() {
+		return tgbotapi.FileReader{Name: res.Name, Reader: bytes.NewReader(res.Data)}
+	}
+	return tgbotapi.FilePath(res.FilePath)
+}
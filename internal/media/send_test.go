@@ -0,0 +1,79 @@
+package media
+
+import (
+	"encoding/json"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestAlbumParams(t *testing.T) {
+	items := []Item{
+		{Kind: "photo", File: tgbotapi.FileBytes{Name: "a.jpg", Bytes: []byte("a")}, Caption: "<b>first</b>", ParseMode: "HTML"},
+		{Kind: "document", File: tgbotapi.FileID("doc-id")},
+		{Kind: "photo", File: tgbotapi.FileURL("https://example.com/b.jpg")},
+	}
+
+	tests := []struct {
+		name     string
+		spoiler  bool
+		warning  string
+		captions []string
+		spoilers []bool
+	}{
+		{
+			name:     "plain",
+			captions: []string{"<b>first</b>", "", ""},
+			spoilers: []bool{false, false, false},
+		},
+		{
+			name:     "spoiler with default warning",
+			spoiler:  true,
+			captions: []string{SpoilerWarning + "\n\n<b>first</b>", SpoilerWarning, SpoilerWarning},
+			spoilers: []bool{true, false, true},
+		},
+		{
+			name:     "spoiler with translated warning",
+			spoiler:  true,
+			warning:  "⚠️ Konten sensitif",
+			captions: []string{"⚠️ Konten sensitif\n\n<b>first</b>", "⚠️ Konten sensitif", "⚠️ Konten sensitif"},
+			spoilers: []bool{true, false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, files, err := albumParams(42, items, tt.spoiler, tt.warning)
+			if err != nil {
+				t.Fatalf("albumParams: %v", err)
+			}
+			if params["chat_id"] != "42" {
+				t.Errorf("chat_id = %q, want 42", params["chat_id"])
+			}
+			if len(files) != 1 || files[0].Name != "file-0" {
+				t.Fatalf("files = %+v, want only file-0", files)
+			}
+
+			var media []struct {
+				Type       string `json:"type"`
+				Media      string `json:"media"`
+				Caption    string `json:"caption"`
+				HasSpoiler bool   `json:"has_spoiler"`
+			}
+			if err := json.Unmarshal([]byte(params["media"]), &media); err != nil {
+				t.Fatalf("media is not JSON: %v", err)
+			}
+			wantMedia := []string{"attach://file-0", "doc-id", "https://example.com/b.jpg"}
+			for i, m := range media {
+				if m.Type != items[i].Kind || m.Media != wantMedia[i] {
+					t.Errorf("item %d = %s %q, want %s %q", i, m.Type, m.Media, items[i].Kind, wantMedia[i])
+				}
+				if m.Caption != tt.captions[i] {
+					t.Errorf("item %d caption = %q, want %q", i, m.Caption, tt.captions[i])
+				}
+				if m.HasSpoiler != tt.spoilers[i] {
+					t.Errorf("item %d has_spoiler = %t, want %t", i, m.HasSpoiler, tt.spoilers[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+// Package metrics holds the process-wide counters exported on /debug/vars.
+package metrics
+
+import "expvar"
+
+var (
+	QueueDepth    = expvar.NewInt("queue_depth")
+	QueueRejected = expvar.NewInt("queue_rejected")
+
+	// HandlerPanics counts recovered panics keyed by command name.
+	HandlerPanics = expvar.NewMap("handler_panics")
+
+	// ProviderRequests counts API calls keyed "<provider>:ok" or
+	// "<provider>:error".
+	ProviderRequests = expvar.NewMap("provider_requests")
+)
@@ -0,0 +1,155 @@
+// Package prefetch keeps a few waifus fetched and downloaded ahead of time
+// so most pulls can be answered without waiting on the providers.
+package prefetch
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"yume-go/internal/api"
+	"yume-go/internal/util"
+)
+
+// Bucket separates buffered items by what they may be used for.
+type Bucket struct {
+	NSFW bool
+	Tag  string
+}
+
+type Item struct {
+	Waifu     *api.Waifu
+	Result    *util.DownloadResult
+	FetchedAt time.Time
+}
+
+// FetchFunc fetches and downloads one waifu for b.
+type FetchFunc func(b Bucket) (*api.Waifu, *util.DownloadResult, error)
+
+const (
+	itemTTL      = 30 * time.Minute
+	errorBackoff = 30 * time.Second
+)
+
+type Prefetcher struct {
+	fetch    FetchFunc
+	size     int
+	interval time.Duration
+
+	// slot spaces out background fetches across all buckets so the
+	// prefetcher never outpaces the providers' rate limits.
+	slot chan struct{}
+
+	mu        sync.Mutex
+	buffers   map[Bucket][]*Item
+	refilling map[Bucket]bool
+}
+
+// New creates a prefetcher holding up to size items per bucket and
+// fetching at most once per interval.
+func New(fetch FetchFunc, size int, interval time.Duration) *Prefetcher {
+	p := &Prefetcher{
+		fetch:     fetch,
+		size:      size,
+		interval:  interval,
+		slot:      make(chan struct{}, 1),
+		buffers:   make(map[Bucket][]*Item),
+		refilling: make(map[Bucket]bool),
+	}
+	p.slot <- struct{}{}
+	return p
+}
+
+// Get pops a ready item for b, if any, and schedules a refill either way.
+// The caller owns the item's download and must clean it up.
+func (p *Prefetcher) Get(b Bucket) (*Item, bool) {
+	if p.size <= 0 {
+		return nil, false
+	}
+	defer p.Warm(b)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	buf := p.buffers[b]
+	for len(buf) > 0 {
+		item := buf[0]
+		buf = buf[1:]
+		if time.Since(item.FetchedAt) < itemTTL {
+			p.buffers[b] = buf
+			return item, true
+		}
+		item.Result.Cleanup()
+	}
+	p.buffers[b] = buf
+	return nil, false
+}
+
+// Put returns an item taken with Get that could not be used, such as one
+// the user saw recently, so another pull can have it. It is dropped when
+// the buffer is already full again.
+func (p *Prefetcher) Put(b Bucket, item *Item) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buffers[b]) >= p.size || time.Since(item.FetchedAt) >= itemTTL {
+		item.Result.Cleanup()
+		return
+	}
+	p.buffers[b] = append(p.buffers[b], item)
+}
+
+// Warm starts filling b in the background unless that is already running.
+func (p *Prefetcher) Warm(b Bucket) {
+	if p.size <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.refilling[b] || len(p.buffers[b]) >= p.size {
+		return
+	}
+	p.refilling[b] = true
+	go p.refill(b)
+}
+
+func (p *Prefetcher) refill(b Bucket) {
+	defer func() {
+		p.mu.Lock()
+		p.refilling[b] = false
+		p.mu.Unlock()
+	}()
+
+	for {
+		p.mu.Lock()
+		full := len(p.buffers[b]) >= p.size
+		p.mu.Unlock()
+		if full {
+			return
+		}
+
+		<-p.slot
+		waifu, result, err := p.fetch(b)
+		time.AfterFunc(p.interval, func() { p.slot <- struct{}{} })
+
+		if err != nil {
+			log.Printf("[prefetch] bucket nsfw=%t tag=%q: %v", b.NSFW, b.Tag, err)
+			time.Sleep(errorBackoff)
+			return
+		}
+
+		p.mu.Lock()
+		p.buffers[b] = append(p.buffers[b], &Item{
+			Waifu:     waifu,
+			Result:    result,
+			FetchedAt: time.Now(),
+		})
+		p.mu.Unlock()
+	}
+}
+
+// Len reports how many items are buffered for b.
+func (p *Prefetcher) Len(b Bucket) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.buffers[b])
+}
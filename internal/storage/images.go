@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxImages caps the canonical image records kept for duplicate
+	// detection; the oldest are dropped once it is exceeded.
+	maxImages = 50_000
+	hashBands = 8
+)
+
+// Image is one known artwork, keyed by the ID of the first copy seen.
+// Aliases are the IDs of copies found later, e.g. at other providers.
+type Image struct {
+	ID        string    `json:"id"`
+	PHash     uint64    `json:"phash"`
+	Source    string    `json:"source"`
+	FirstSeen time.Time `json:"first_seen"`
+	Aliases   []string  `json:"aliases,omitempty"`
+}
+
+// imageSet holds the known images in their own file next to the data
+// file, under their own lock, so duplicate checks never wait on user and
+// chat updates and the main file stays small.
+type imageSet struct {
+	path string
+
+	mu   sync.RWMutex
+	byID map[string]*Image
+	// index finds canonical images by hash band; see nearest.
+	index map[uint16][]*Image
+	count int
+
+	dirty  atomic.Bool
+	saveMu sync.Mutex
+}
+
+// imagesPath puts the image file next to the data file, e.g.
+// data/yume.images.json for data/yume.json.
+func imagesPath(dataPath string) string {
+	ext := filepath.Ext(dataPath)
+	return strings.TrimSuffix(dataPath, ext) + ".images" + ext
+}
+
+// openImages loads the image file. Older data files kept images inline,
+// with aliases as copies of the canonical record; those are taken over
+// from legacy when there is no image file yet.
+func openImages(path string, legacy map[string]*Image) (*imageSet, error) {
+	set := &imageSet{path: path, byID: make(map[string]*Image)}
+
+	var records []*Image
+	raw, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		records = fromLegacy(legacy)
+		if len(records) > 0 {
+			log.Printf("Moving %d images out of the data file into %s", len(records), path)
+			set.dirty.Store(true)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to read image file: %w", err)
+	default:
+		if err := json.Unmarshal(raw, &records); err != nil {
+			return nil, fmt.Errorf("failed to parse image file: %w", err)
+		}
+	}
+
+	for _, img := range records {
+		set.byID[img.ID] = img
+		for _, alias := range img.Aliases {
+			set.byID[alias] = img
+		}
+	}
+	set.reindex()
+	return set, nil
+}
+
+func fromLegacy(legacy map[string]*Image) []*Image {
+	canonical := make(map[string]*Image)
+	for id, img := range legacy {
+		if id == img.ID {
+			canonical[id] = img
+		}
+	}
+	for id, img := range legacy {
+		if c, ok := canonical[img.ID]; ok && id != img.ID {
+			c.Aliases = append(c.Aliases, id)
+		}
+	}
+	records := make([]*Image, 0, len(canonical))
+	for _, img := range canonical {
+		records = append(records, img)
+	}
+	return records
+}
+
+// flush writes the image file if anything changed. Encoding only needs the
+// read lock, so lookups carry on meanwhile.
+func (set *imageSet) flush() error {
+	set.saveMu.Lock()
+	defer set.saveMu.Unlock()
+	if !set.dirty.Load() {
+		return nil
+	}
+
+	set.mu.RLock()
+	set.dirty.Store(false)
+	records := make([]*Image, 0, set.count)
+	for id, img := range set.byID {
+		if id == img.ID {
+			records = append(records, img)
+		}
+	}
+	raw, err := json.Marshal(records)
+	set.mu.RUnlock()
+	if err == nil {
+		err = writeFile(set.path, raw)
+	}
+	if err != nil {
+		set.dirty.Store(true)
+		return fmt.Errorf("image file: %w", err)
+	}
+	return nil
+}
+
+// resolve maps an alias to its canonical ID; unknown IDs are returned
+// unchanged.
+func (set *imageSet) resolve(id string) string {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	if img, ok := set.byID[id]; ok {
+		return img.ID
+	}
+	return id
+}
+
+// CanonicalImage returns the ID of a known image that is id itself, an
+// alias of it, or within maxDistance bits of phash, so the same artwork
+// served by different providers shares one ID. It returns id when the
+// image is new. Nothing is recorded; see RecordImage.
+func (s *Store) CanonicalImage(id string, phash uint64, maxDistance int) string {
+	set := s.images
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	if img, ok := set.byID[id]; ok {
+		return img.ID
+	}
+	if match := set.nearest(phash, maxDistance); match != nil {
+		return match.ID
+	}
+	return id
+}
+
+// RecordImage remembers an image that was sent, under id or, when it
+// duplicates a known image, as an alias of that one. It returns the
+// canonical ID. The image file is written by the periodic flush.
+func (s *Store) RecordImage(id string, phash uint64, source string, maxDistance int) string {
+	set := s.images
+	set.mu.RLock()
+	known, isKnown := set.byID[id]
+	var match *Image
+	if !isKnown {
+		match = set.nearest(phash, maxDistance)
+	}
+	set.mu.RUnlock()
+	if isKnown {
+		return known.ID
+	}
+
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	// Another pull may have recorded the image, or pruning dropped the
+	// match, while the lock was released.
+	if img, ok := set.byID[id]; ok {
+		return img.ID
+	}
+	if match != nil && set.byID[match.ID] == match {
+		match.Aliases = append(match.Aliases, id)
+		set.byID[id] = match
+		set.dirty.Store(true)
+		return match.ID
+	}
+
+	img := &Image{
+		ID:        id,
+		PHash:     phash,
+		Source:    source,
+		FirstSeen: time.Now(),
+	}
+	set.byID[id] = img
+	set.add(img)
+	if set.count > maxImages {
+		set.prune()
+	}
+	set.dirty.Store(true)
+	return id
+}
+
+func bandKey(hash uint64, band int) uint16 {
+	return uint16(band)<<8 | uint16(hash>>(band*8)&0xFF)
+}
+
+// add puts a canonical record into the index. The caller must hold
+// set.mu for writing.
+func (set *imageSet) add(img *Image) {
+	for b := range hashBands {
+		k := bandKey(img.PHash, b)
+		set.index[k] = append(set.index[k], img)
+	}
+	set.count++
+}
+
+// reindex rebuilds the index from the canonical records, the ones stored
+// under their own ID. The caller must hold set.mu for writing.
+func (set *imageSet) reindex() {
+	set.index = make(map[uint16][]*Image)
+	set.count = 0
+	for id, img := range set.byID {
+		if id == img.ID {
+			set.add(img)
+		}
+	}
+}
+
+// nearest returns the canonical image closest to phash, or nil when none
+// is within maxDistance bits. Hashes fewer than hashBands bits apart agree
+// on at least one whole band, so only images sharing a band are compared;
+// larger distances fall back to a full scan. The caller must hold set.mu.
+func (set *imageSet) nearest(phash uint64, maxDistance int) *Image {
+	var best *Image
+	bestDist := maxDistance + 1
+	consider := func(img *Image) {
+		if d := bits.OnesCount64(img.PHash ^ phash); d < bestDist {
+			best, bestDist = img, d
+		}
+	}
+	if maxDistance < hashBands {
+		for b := range hashBands {
+			for _, img := range set.index[bandKey(phash, b)] {
+				consider(img)
+			}
+		}
+		return best
+	}
+	for id, img := range set.byID {
+		if id == img.ID {
+			consider(img)
+		}
+	}
+	return best
+}
+
+// prune drops the oldest canonical images and their aliases, down to nine
+// tenths of maxImages so it does not run on every insert. The caller must
+// hold set.mu for writing.
+func (set *imageSet) prune() {
+	var canonical []*Image
+	for id, img := range set.byID {
+		if id == img.ID {
+			canonical = append(canonical, img)
+		}
+	}
+	slices.SortFunc(canonical, func(a, b *Image) int {
+		return a.FirstSeen.Compare(b.FirstSeen)
+	})
+	drop := canonical[:len(canonical)-maxImages*9/10]
+	for _, img := range drop {
+		delete(set.byID, img.ID)
+		for _, alias := range img.Aliases {
+			delete(set.byID, alias)
+		}
+	}
+	set.reindex()
+	log.Printf("Pruned %d old images from the duplicate index", len(drop))
+}
+
+// len reports the number of canonical images.
+func (set *imageSet) len() int {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	return set.count
+}
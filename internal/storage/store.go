@@ -0,0 +1,587 @@
+// Package storage persists per-user and per-chat state in a JSON file.
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type User struct {
+	ID       int64     `json:"id"`
+	Username string    `json:"username,omitempty"`
+	Anu      bool      `json:"anu"`
+	Lang     string    `json:"lang,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+	// ConsentAt records when the user confirmed the anu consent prompt.
+	ConsentAt time.Time `json:"consent_at,omitzero"`
+	// Recent holds the images last sent to the user, oldest first.
+	Recent []SeenImage `json:"recent,omitempty"`
+}
+
+type SeenImage struct {
+	ID       string `json:"id"`
+	PHash    uint64 `json:"phash,omitempty"`
+	HasPHash bool   `json:"has_phash,omitempty"`
+}
+
+// Content policies a chat can choose. They override the members' own
+// anu preference.
+const (
+	PolicySFWOnly     = "sfw-only"
+	PolicyAllowNSFW   = "allow-nsfw"
+	PolicyNSFWSpoiler = "nsfw-spoiler"
+)
+
+var Policies = []string{PolicySFWOnly, PolicyAllowNSFW, PolicyNSFWSpoiler}
+
+type Chat struct {
+	ID       int64     `json:"id"`
+	Type     string    `json:"type"`
+	Policy   string    `json:"policy,omitempty"`
+	Lang     string    `json:"lang,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+	// Blocked is set when a broadcast found the bot blocked or removed
+	// from the chat. It clears once the chat talks to the bot again.
+	Blocked bool `json:"blocked,omitempty"`
+}
+
+// ContentPolicy returns the chat's policy. Groups default to sfw-only,
+// private chats to allow-nsfw; spoilers are opt-in with /policy.
+func (c Chat) ContentPolicy() string {
+	if c.Policy != "" {
+		return c.Policy
+	}
+	if c.Type == "private" {
+		return PolicyAllowNSFW
+	}
+	return PolicySFWOnly
+}
+
+// Settings are bot-wide switches changed at runtime by admins.
+type Settings struct {
+	ForceSFW bool `json:"force_sfw"`
+	// SourceWeights and DisabledSources are runtime overrides of the
+	// configured providers, set with /admin source. They outlive config
+	// reloads. Replace the map or slice instead of editing it in place, as
+	// Settings() hands out shallow copies.
+	SourceWeights   map[string]int `json:"source_weights,omitempty"`
+	DisabledSources []string       `json:"disabled_sources,omitempty"`
+}
+
+// Ban keeps a user away from the bot, everywhere when ChatID is 0 or in
+// one chat otherwise. Lifted bans stay on record for auditing.
+type Ban struct {
+	UserID   int64     `json:"user_id"`
+	ChatID   int64     `json:"chat_id,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	By       int64     `json:"by"`
+	At       time.Time `json:"at"`
+	Until    time.Time `json:"until,omitzero"`
+	LiftedBy int64     `json:"lifted_by,omitempty"`
+	LiftedAt time.Time `json:"lifted_at,omitzero"`
+}
+
+// Active reports whether the ban applies at now.
+func (b Ban) Active(now time.Time) bool {
+	return b.LiftedAt.IsZero() && (b.Until.IsZero() || now.Before(b.Until))
+}
+
+type data struct {
+	Users map[int64]*User `json:"users"`
+	Chats map[int64]*Chat `json:"chats"`
+	// Images is only read, from data files written before images moved
+	// to their own file; see openImages.
+	Images   map[string]*Image `json:"images,omitempty"`
+	Bans     []Ban             `json:"bans,omitempty"`
+	Settings Settings          `json:"settings"`
+}
+
+// Store keeps everything in memory and writes the whole file on change.
+// Explicit updates are saved immediately; bookkeeping such as last-seen
+// times is flushed periodically by StartAutoFlush. Known images live in a
+// separate file; see imageSet.
+type Store struct {
+	path string
+
+	mu    sync.RWMutex
+	data  data
+	dirty atomic.Bool
+	// saveMu serializes writes to the data file. Explicit updates hold it
+	// from change to save, so a rollback never undoes another update.
+	saveMu sync.Mutex
+
+	images *imageSet
+
+	// banIndex holds, per user, the positions in Bans of bans that were
+	// not lifted, so ActiveBan does not scan the whole history.
+	banIndex map[int64][]int
+}
+
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path: path,
+		data: data{
+			Users: make(map[int64]*User),
+			Chats: make(map[int64]*Chat),
+		},
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No data file at %s, starting empty", path)
+		s.reindexBans()
+		if s.images, err = openImages(imagesPath(path), nil); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data file: %w", err)
+	}
+	if err := json.Unmarshal(raw, &s.data); err != nil {
+		return nil, fmt.Errorf("failed to parse data file: %w", err)
+	}
+	if s.data.Users == nil {
+		s.data.Users = make(map[int64]*User)
+	}
+	if s.data.Chats == nil {
+		s.data.Chats = make(map[int64]*Chat)
+	}
+	s.reindexBans()
+	if s.images, err = openImages(imagesPath(path), s.data.Images); err != nil {
+		return nil, err
+	}
+	if s.data.Images != nil {
+		s.data.Images = nil
+		s.dirty.Store(true)
+	}
+	log.Printf("Loaded %d users and %d chats from %s", len(s.data.Users), len(s.data.Chats), path)
+	return s, nil
+}
+
+// save encodes the data under the read lock, so lookups carry on
+// meanwhile, and writes the file atomically. The caller must hold s.saveMu
+// and not s.mu.
+func (s *Store) save() error {
+	s.mu.RLock()
+	s.dirty.Store(false)
+	raw, err := json.Marshal(s.data)
+	s.mu.RUnlock()
+	if err != nil {
+		s.dirty.Store(true)
+		return fmt.Errorf("failed to encode data: %w", err)
+	}
+	if err := writeFile(s.path, raw); err != nil {
+		s.dirty.Store(true)
+		return err
+	}
+	return nil
+}
+
+func writeFile(path string, raw []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create data dir: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return fmt.Errorf("failed to write data file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace data file: %w", err)
+	}
+	return nil
+}
+
+// Flush writes whatever changed since the last save.
+func (s *Store) Flush() error {
+	err := s.images.flush()
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if s.dirty.Load() {
+		err = errors.Join(err, s.save())
+	}
+	return err
+}
+
+func (s *Store) StartAutoFlush(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.Flush(); err != nil {
+				log.Printf("storage flush error: %v", err)
+			}
+		}
+	}()
+}
+
+func (s *Store) user(id int64) *User {
+	u, ok := s.data.Users[id]
+	if !ok {
+		u = &User{ID: id}
+		s.data.Users[id] = u
+	}
+	return u
+}
+
+func (s *Store) chat(id int64) *Chat {
+	c, ok := s.data.Chats[id]
+	if !ok {
+		c = &Chat{ID: id}
+		s.data.Chats[id] = c
+	}
+	return c
+}
+
+// User returns a copy of the user's record, or a zero record with the ID
+// set when the user is unknown.
+func (s *Store) User(id int64) User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if u, ok := s.data.Users[id]; ok {
+		return *u
+	}
+	return User{ID: id}
+}
+
+// UpdateUser applies fn to a copy of the user's record and saves it. If
+// saving fails the old record is put back.
+func (s *Store) UpdateUser(id int64, fn func(*User)) error {
+	return update(s, s.data.Users, id, User{ID: id}, fn)
+}
+
+func (s *Store) Chat(id int64) Chat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if c, ok := s.data.Chats[id]; ok {
+		return *c
+	}
+	return Chat{ID: id}
+}
+
+// UpdateChat works like UpdateUser.
+func (s *Store) UpdateChat(id int64, fn func(*Chat)) error {
+	return update(s, s.data.Chats, id, Chat{ID: id}, fn)
+}
+
+// update installs fn's changes to a copy of m[id], zero when missing, and
+// saves. On failure the old record is restored unless bookkeeping such as
+// MigrateChat replaced it meanwhile.
+func update[T any](s *Store, m map[int64]*T, id int64, zero T, fn func(*T)) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	old, existed := m[id]
+	next := &zero
+	if existed {
+		*next = *old
+	}
+	fn(next)
+	m[id] = next
+	s.mu.Unlock()
+
+	if err := s.save(); err != nil {
+		s.mu.Lock()
+		if m[id] == next {
+			if existed {
+				m[id] = old
+			} else {
+				delete(m, id)
+			}
+		}
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *Store) Settings() Settings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.data.Settings
+}
+
+// UpdateSettings works like UpdateUser.
+func (s *Store) UpdateSettings(fn func(*Settings)) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	old := s.data.Settings
+	next := old
+	next.SourceWeights = maps.Clone(old.SourceWeights)
+	next.DisabledSources = slices.Clone(old.DisabledSources)
+	fn(&next)
+	s.data.Settings = next
+	s.mu.Unlock()
+
+	if err := s.save(); err != nil {
+		s.mu.Lock()
+		s.data.Settings = old
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// TouchUser records that the user was seen, without saving right away.
+func (s *Store) TouchUser(id int64, username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.user(id)
+	u.Username = username
+	u.LastSeen = time.Now()
+	s.dirty.Store(true)
+}
+
+// TouchChat records that the chat was seen, without saving right away.
+func (s *Store) TouchChat(id int64, chatType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.chat(id)
+	c.Type = chatType
+	c.LastSeen = time.Now()
+	c.Blocked = false
+	s.dirty.Store(true)
+}
+
+// BroadcastTargets lists the chats a broadcast should go to, skipping the
+// ones known to have blocked the bot.
+func (s *Store) BroadcastTargets() []int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]int64, 0, len(s.data.Chats))
+	for id, c := range s.data.Chats {
+		if !c.Blocked {
+			out = append(out, id)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// SetBlocked marks a chat as unreachable, without saving right away.
+func (s *Store) SetBlocked(id int64, blocked bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chat(id).Blocked = blocked
+	s.dirty.Store(true)
+}
+
+// MigrateChat moves a group's settings and chat bans to the supergroup
+// that replaced it; Telegram never delivers to the old ID again. Settings
+// already stored for newID win. It is flushed with the periodic save.
+func (s *Store) MigrateChat(oldID, newID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.data.Chats[oldID]; ok {
+		if _, exists := s.data.Chats[newID]; !exists {
+			c := *old
+			c.ID, c.Type, c.Blocked = newID, "supergroup", false
+			s.data.Chats[newID] = &c
+		}
+		delete(s.data.Chats, oldID)
+	}
+	for i := range s.data.Bans {
+		if s.data.Bans[i].ChatID == oldID {
+			s.data.Bans[i].ChatID = newID
+		}
+	}
+	s.dirty.Store(true)
+}
+
+// RecentlySeen reports whether the user was recently sent the image, by
+// canonical ID or, when a hash is given, by perceptual similarity.
+func (s *Store) RecentlySeen(userID int64, img SeenImage, maxDistance int) bool {
+	id := s.images.resolve(img.ID)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.data.Users[userID]
+	if !ok {
+		return false
+	}
+	for _, seen := range u.Recent {
+		if seen.ID == id {
+			return true
+		}
+		if img.HasPHash && seen.HasPHash && bits.OnesCount64(seen.PHash^img.PHash) <= maxDistance {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkSeen appends img to the user's recent window, keeping the last
+// window entries. It is flushed with the periodic save.
+func (s *Store) MarkSeen(userID int64, img SeenImage, window int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.user(userID)
+	u.Recent = append(u.Recent, img)
+	if len(u.Recent) > window {
+		u.Recent = append([]SeenImage(nil), u.Recent[len(u.Recent)-window:]...)
+	}
+	s.dirty.Store(true)
+}
+
+// AddBan records a ban, lifting any active ban with the same scope so the
+// newest reason and expiry win. Nothing changes if saving fails.
+func (s *Store) AddBan(b Ban) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	prev := slices.Clone(s.data.Bans)
+	s.lift(b.UserID, b.ChatID, b.By, b.At)
+	s.data.Bans = append(s.data.Bans, b)
+	s.banIndex[b.UserID] = append(s.banIndex[b.UserID], len(s.data.Bans)-1)
+	s.mu.Unlock()
+
+	if err := s.save(); err != nil {
+		s.restoreBans(prev)
+		return err
+	}
+	return nil
+}
+
+// LiftBan ends the user's active ban in chatID (0 for the global one). It
+// reports whether there was one.
+func (s *Store) LiftBan(userID, chatID, by int64) (bool, error) {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	prev := slices.Clone(s.data.Bans)
+	lifted := s.lift(userID, chatID, by, time.Now())
+	s.mu.Unlock()
+	if !lifted {
+		return false, nil
+	}
+
+	if err := s.save(); err != nil {
+		s.restoreBans(prev)
+		return false, err
+	}
+	return true, nil
+}
+
+// restoreBans rolls Bans back after a failed save.
+func (s *Store) restoreBans(prev []Ban) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Bans = prev
+	s.reindexBans()
+}
+
+// lift marks the user's active bans in chatID as lifted and drops them
+// from banIndex. The caller must hold s.mu for writing.
+func (s *Store) lift(userID, chatID, by int64, at time.Time) bool {
+	lifted := false
+	kept := s.banIndex[userID][:0]
+	for _, i := range s.banIndex[userID] {
+		b := &s.data.Bans[i]
+		if b.ChatID == chatID && b.Active(at) {
+			b.LiftedBy, b.LiftedAt = by, at
+			lifted = true
+			continue
+		}
+		kept = append(kept, i)
+	}
+	if len(kept) == 0 {
+		delete(s.banIndex, userID)
+	} else {
+		s.banIndex[userID] = kept
+	}
+	return lifted
+}
+
+// reindexBans rebuilds banIndex from Bans. The caller must hold s.mu for
+// writing.
+func (s *Store) reindexBans() {
+	s.banIndex = make(map[int64][]int)
+	for i, b := range s.data.Bans {
+		if b.LiftedAt.IsZero() {
+			s.banIndex[b.UserID] = append(s.banIndex[b.UserID], i)
+		}
+	}
+}
+
+// ActiveBan returns the ban keeping the user out of chatID, checking the
+// global ban first.
+func (s *Store) ActiveBan(userID, chatID int64) (Ban, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	var found *Ban
+	for _, i := range s.banIndex[userID] {
+		b := &s.data.Bans[i]
+		if !b.Active(now) {
+			continue
+		}
+		if b.ChatID == 0 {
+			return *b, true
+		}
+		if b.ChatID == chatID {
+			found = b
+		}
+	}
+	if found != nil {
+		return *found, true
+	}
+	return Ban{}, false
+}
+
+// Counts summarizes what the store knows about.
+type Counts struct {
+	Users    int
+	AnuUsers int
+	Chats    int
+	Groups   int
+	Images   int
+}
+
+func (s *Store) Counts() Counts {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c := Counts{Users: len(s.data.Users), Chats: len(s.data.Chats)}
+	for _, u := range s.data.Users {
+		if u.Anu {
+			c.AnuUsers++
+		}
+	}
+	for _, ch := range s.data.Chats {
+		if ch.Type == "group" || ch.Type == "supergroup" {
+			c.Groups++
+		}
+	}
+	c.Images = s.images.len()
+	return c
+}
+
+// FindUsername looks up a user ID by username, case-insensitively.
+func (s *Store) FindUsername(username string) (int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.data.Users {
+		if u.Username != "" && strings.EqualFold(u.Username, username) {
+			return u.ID, true
+		}
+	}
+	return 0, false
+}
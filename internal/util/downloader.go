@@ -1,114 +1,370 @@
 package util
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"image"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
+var ErrTooLarge = errors.New("file exceeds the download size limit")
+
 type DownloadResult struct {
+	// Name is the file name to upload under, with the sniffed extension.
+	Name string
+	// Data holds the file when it fit in memory; FilePath is set instead
+	// when it spilled to disk.
+	Data       []byte
 	FilePath   string
 	FolderPath string
 	FileSize   int64
+	Format     string
+	Width      int
+	Height     int
+	Animated   bool
+	// PHash is the perceptual hash of the image (the first frame for
+	// animations). HasPHash is false for formats that cannot be decoded.
+	PHash    uint64
+	HasPHash bool
 }
 
-func DownloadToTemp(url string, identifier string) (*DownloadResult, error) {
-	tmpBase := os.TempDir()
-	folderName := fmt.Sprintf("waifu_%s_%d", identifier, time.Now().Unix())
-	folderPath := filepath.Join(tmpBase, folderName)
+func (r *DownloadResult) InMemory() bool {
+	return r.FilePath == ""
+}
 
-	if err := os.MkdirAll(folderPath, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create temp folder: %w", err)
+// Open returns a reader over the downloaded bytes, wherever they live.
+func (r *DownloadResult) Open() (io.ReadCloser, error) {
+	if r.InMemory() {
+		return io.NopCloser(bytes.NewReader(r.Data)), nil
 	}
+	return os.Open(r.FilePath)
+}
 
-	log.Printf("Created temp folder: %s", folderPath)
+// Cleanup removes the temp folder of a download that spilled to disk.
+func (r *DownloadResult) Cleanup() {
+	if r.FolderPath != "" {
+		CleanupTemp(r.FolderPath)
+	}
+}
+
+type DownloadOptions struct {
+	// Client is the shared HTTP client; it supplies per-host headers and
+	// retries failed requests and 429/5xx responses within each attempt's
+	// timeout.
+	Client *http.Client
+	// MemoryLimit is the largest file kept in memory; bigger ones are
+	// streamed into a temp folder.
+	MemoryLimit int64
+	// MaxSize is a hard limit. Larger files fail with ErrTooLarge.
+	MaxSize int64
+	// Timeout applies to each attempt unless HostTimeouts has an entry for
+	// the URL's host or one of its parent domains; the longest match wins.
+	Timeout      time.Duration
+	HostTimeouts map[string]time.Duration
+	// Retries is how many times a body cut off mid-transfer is resumed.
+	Retries int
+}
 
-	client := &http.Client{
-		Timeout: 60 * time.Second,
+func (o DownloadOptions) timeoutFor(rawURL string) time.Duration {
+	if u, err := url.Parse(rawURL); err == nil {
+		host := u.Hostname()
+		timeout, best := o.Timeout, -1
+		for h, t := range o.HostTimeouts {
+			if len(h) > best && (host == h || strings.HasSuffix(host, "."+h)) {
+				timeout, best = t, len(h)
+			}
+		}
+		return timeout
 	}
+	return o.Timeout
+}
+
+// Download fetches rawURL, resuming with Range requests when the transfer
+// is cut off, and validates the result as an image.
+func Download(rawURL string, identifier string, opts DownloadOptions) (*DownloadResult, error) {
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	timeout := opts.timeoutFor(rawURL)
+
+	result := &DownloadResult{}
+	s := &sink{result: result, identifier: identifier, memLimit: opts.MemoryLimit}
+	defer s.close()
+
+	for attempt := 0; ; attempt++ {
+		retry, err := fetchInto(client, rawURL, timeout, s, opts.MaxSize)
+		if err == nil {
+			break
+		}
+		if !retry || attempt >= opts.Retries {
+			result.Cleanup()
+			return nil, err
+		}
+		log.Printf("Download of %s interrupted at %d bytes, retrying (%d/%d): %v",
+			identifier, s.n, attempt+1, opts.Retries, err)
+		time.Sleep(time.Duration(attempt+1) * 500 * time.Millisecond)
+	}
+	if err := s.close(); err != nil {
+		result.Cleanup()
+		return nil, fmt.Errorf("failed to write file: %w", err)
+	}
+
+	written := s.n
+	result.FileSize = written
+	if result.InMemory() {
+		result.Data = s.buf.Bytes()
+	}
+
+	if written < 512 {
+		result.Cleanup()
+		return nil, fmt.Errorf("file too small: %d bytes", written)
+	}
+
+	var info ImageInfo
+	var err error
+	if result.InMemory() {
+		info, err = InspectBytes(result.Data)
+	} else {
+		info, err = InspectImage(result.FilePath)
+	}
+	if err != nil {
+		result.Cleanup()
+		return nil, fmt.Errorf("invalid image: %w", err)
+	}
+
+	result.Name = "waifu_" + identifier + formatExt[info.Format]
+	result.Format = info.Format
+	result.Width = info.Width
+	result.Height = info.Height
+	result.Animated = info.Animated
+	result.PHash, result.HasPHash = perceptualHash(result)
+
+	where := "memory"
+	if !result.InMemory() {
+		finalPath := filepath.Join(result.FolderPath, result.Name)
+		if err := os.Rename(result.FilePath, finalPath); err != nil {
+			result.Cleanup()
+			return nil, fmt.Errorf("failed to rename file: %w", err)
+		}
+		result.FilePath = finalPath
+		where = finalPath
+	}
+
+	log.Printf("Downloaded: %s to %s (%.2f MB, %s %dx%d)", result.Name, where,
+		float64(written)/(1024*1024), info.Format, info.Width, info.Height)
+
+	return result, nil
+}
+
+// perceptualHash decodes the image to compute its DHash. WebP cannot be
+// decoded and images over maxDecodePixels are not worth the memory, so
+// both go unhashed and fall back to ID-based duplicate checks.
+func perceptualHash(res *DownloadResult) (uint64, bool) {
+	if res.Format == "webp" || res.Width*res.Height > maxDecodePixels {
+		return 0, false
+	}
+	f, err := res.Open()
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		log.Printf("Cannot hash %s: %v", res.Name, err)
+		return 0, false
+	}
+	return DHash(img), true
+}
+
+// fetchInto performs one request, continuing from s.n bytes when some data
+// already arrived. retry reports whether the body was cut off and can be
+// resumed; failed requests were already retried by the client.
+func fetchInto(client *http.Client, rawURL string, timeout time.Duration, s *sink, maxSize int64) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
 	if err != nil {
-		os.RemoveAll(folderPath)
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return false, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
 	req.Header.Set("Accept", "image/webp,image/apng,image/*,*/*;q=0.8")
-	req.Header.Set("Referer", "https://waifu.im/")
+	if s.n > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", s.n))
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		os.RemoveAll(folderPath)
-		return nil, fmt.Errorf("failed to download: %w", err)
+		return false, fmt.Errorf("failed to download: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		os.RemoveAll(folderPath)
-		return nil, fmt.Errorf("bad status code: %d", resp.StatusCode)
+	total := resp.ContentLength
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && s.n > 0:
+		start, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != s.n {
+			return false, fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+		total = size
+	case resp.StatusCode == http.StatusOK:
+		if s.n > 0 {
+			log.Printf("Server ignored Range request, restarting download")
+			if err := s.reset(); err != nil {
+				return false, err
+			}
+		}
+	default:
+		return false, fmt.Errorf("bad status code: %d", resp.StatusCode)
 	}
 
-	ext := getImageExtension(resp.Header.Get("Content-Type"))
-	filename := fmt.Sprintf("waifu_%s%s", identifier, ext)
-	filePath := filepath.Join(folderPath, filename)
+	if maxSize > 0 && total > maxSize {
+		return false, fmt.Errorf("%w: %d bytes announced, limit is %d", ErrTooLarge, total, maxSize)
+	}
 
-	out, err := os.Create(filePath)
-	if err != nil {
-		os.RemoveAll(folderPath)
-		return nil, fmt.Errorf("failed to create file: %w", err)
+	body := io.Reader(resp.Body)
+	if maxSize > 0 {
+		body = io.LimitReader(resp.Body, maxSize-s.n+1)
+	}
+	if _, err := io.Copy(s, body); err != nil {
+		return !errors.Is(err, errSink), fmt.Errorf("download interrupted: %w", err)
+	}
+	if maxSize > 0 && s.n > maxSize {
+		return false, fmt.Errorf("%w: limit is %d bytes", ErrTooLarge, maxSize)
 	}
-	defer out.Close()
+	if total >= 0 && s.n < total {
+		return true, fmt.Errorf("download interrupted: got %d of %d bytes", s.n, total)
+	}
+	return false, nil
+}
 
-	maxSize := int64(50 * 1024 * 1024)
-	limitedReader := io.LimitReader(resp.Body, maxSize)
-	written, err := io.Copy(out, limitedReader)
+// parseContentRange reads "bytes start-end/size"; size is -1 when unknown.
+func parseContentRange(v string) (start, size int64, ok bool) {
+	v, found := strings.CutPrefix(v, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	rng, sizeStr, found := strings.Cut(v, "/")
+	if !found {
+		return 0, 0, false
+	}
+	startStr, _, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
 	if err != nil {
-		os.RemoveAll(folderPath)
-		return nil, fmt.Errorf("failed to write file: %w", err)
+		return 0, 0, false
+	}
+	size = -1
+	if sizeStr != "*" {
+		if size, err = strconv.ParseInt(sizeStr, 10, 64); err != nil {
+			return 0, 0, false
+		}
 	}
+	return start, size, true
+}
 
-	if written < 512 {
-		os.RemoveAll(folderPath)
-		return nil, fmt.Errorf("file too small: %d bytes", written)
+var errSink = errors.New("local write failed")
+
+// sink collects the body in memory and switches to a temp file once it
+// grows past memLimit.
+type sink struct {
+	result     *DownloadResult
+	identifier string
+	memLimit   int64
+
+	buf  bytes.Buffer
+	file *os.File
+	n    int64
+}
+
+func (s *sink) Write(p []byte) (int, error) {
+	if s.file == nil && int64(s.buf.Len()+len(p)) > s.memLimit {
+		if err := s.spill(); err != nil {
+			return 0, fmt.Errorf("%w: %v", errSink, err)
+		}
 	}
 
-	if written >= maxSize {
-		log.Printf("Warning: file truncated at %d bytes (hit 50MB limit)", written)
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+		if err != nil {
+			err = fmt.Errorf("%w: %v", errSink, err)
+		}
+	} else {
+		n, err = s.buf.Write(p)
 	}
+	s.n += int64(n)
+	return n, err
+}
 
-	log.Printf("Downloaded: %s (%.2f MB)", filePath, float64(written)/(1024*1024))
+func (s *sink) spill() error {
+	folderName := fmt.Sprintf("waifu_%s_%d", s.identifier, time.Now().Unix())
+	folderPath := filepath.Join(os.TempDir(), folderName)
 
-	return &DownloadResult{
-		FilePath:   filePath,
-		FolderPath: folderPath,
-		FileSize:   written,
-	}, nil
+	if err := os.MkdirAll(folderPath, 0755); err != nil {
+		return fmt.Errorf("failed to create temp folder: %w", err)
+	}
+	log.Printf("Created temp folder: %s", folderPath)
+	s.result.FolderPath = folderPath
+
+	filePath := filepath.Join(folderPath, "waifu_"+s.identifier+".part")
+	out, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	if _, err := out.Write(s.buf.Bytes()); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	s.buf = bytes.Buffer{}
+	s.file = out
+	s.result.FilePath = filePath
+	return nil
 }
 
-func CleanupTemp(folderPath string) error {
-	if err := os.RemoveAll(folderPath); err != nil {
-		return fmt.Errorf("failed to cleanup: %w", err)
+// reset discards everything received so far.
+func (s *sink) reset() error {
+	s.n = 0
+	s.buf.Reset()
+	if s.file != nil {
+		if err := s.file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
 	}
-	log.Printf("Cleaned up: %s", folderPath)
 	return nil
 }
 
-var imageExt = map[string]string{
-	"image/jpeg": ".jpg",
-	"image/jpg":  ".jpg",
-	"image/png":  ".png",
-	"image/gif":  ".gif",
-	"image/webp": ".webp",
+func (s *sink) close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
 }
 
-func getImageExtension(contentType string) string {
-	if ext, ok := imageExt[contentType]; ok {
-		return ext
+func CleanupTemp(folderPath string) error {
+	if err := os.RemoveAll(folderPath); err != nil {
+		return fmt.Errorf("failed to cleanup: %w", err)
 	}
-	return ".jpg"
+	log.Printf("Cleaned up: %s", folderPath)
+	return nil
 }
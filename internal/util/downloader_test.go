@@ -0,0 +1,190 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		in          string
+		start, size int64
+		ok          bool
+	}{
+		{"bytes 0-99/100", 0, 100, true},
+		{"bytes 500-999/1000", 500, 1000, true},
+		{"bytes 500-999/*", 500, -1, true},
+		{"bytes 500-/1000", 500, 1000, true},
+		{"", 0, 0, false},
+		{"500-999/1000", 0, 0, false},
+		{"bytes 500-999", 0, 0, false},
+		{"bytes 500/1000", 0, 0, false},
+		{"bytes x-999/1000", 0, 0, false},
+		{"bytes 500-999/big", 0, 0, false},
+		{"bytes */1000", 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, size, ok := parseContentRange(tt.in)
+		if start != tt.start || size != tt.size || ok != tt.ok {
+			t.Errorf("parseContentRange(%q) = %d, %d, %t; want %d, %d, %t",
+				tt.in, start, size, ok, tt.start, tt.size, tt.ok)
+		}
+	}
+}
+
+func TestTimeoutFor(t *testing.T) {
+	opts := DownloadOptions{
+		Timeout: time.Minute,
+		HostTimeouts: map[string]time.Duration{
+			"waifu.pics":   2 * time.Second,
+			"i.waifu.pics": 3 * time.Second,
+			"waifu.im":     4 * time.Second,
+		},
+	}
+	tests := []struct {
+		url  string
+		want time.Duration
+	}{
+		{"https://waifu.pics/a.png", 2 * time.Second},
+		{"https://i.waifu.pics/a.png", 3 * time.Second},
+		{"https://cdn.i.waifu.pics/a.png", 3 * time.Second},
+		{"https://api.waifu.pics/a.png", 2 * time.Second},
+		{"https://cdn.waifu.im:8443/a.png", 4 * time.Second},
+		{"https://notwaifu.im/a.png", time.Minute},
+		{"https://example.com/a.png", time.Minute},
+		{"::not a url", time.Minute},
+	}
+	for _, tt := range tests {
+		if got := opts.timeoutFor(tt.url); got != tt.want {
+			t.Errorf("timeoutFor(%q) = %s, want %s", tt.url, got, tt.want)
+		}
+	}
+}
+
+// noisePNG encodes random pixels so the file is well above the 512 byte
+// minimum and does not compress away.
+func noisePNG(t *testing.T) []byte {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, 48, 32))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rng.Intn(256))
+	}
+	img.Set(0, 0, color.NRGBA{A: 0xFF})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDownloadResumes(t *testing.T) {
+	body := noisePNG(t)
+	cut := int64(len(body) / 2)
+
+	tests := []struct {
+		name        string
+		honourRange bool
+		memLimit    int64
+	}{
+		{"range in memory", true, 1 << 20},
+		{"range spilled to disk", true, 100},
+		{"range ignored", false, 1 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			var ranges []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := requests.Add(1)
+				ranges = append(ranges, r.Header.Get("Range"))
+				if n == 1 {
+					// Announce the whole file, then drop the connection
+					// half way through.
+					w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+					w.Write(body[:cut])
+					w.(http.Flusher).Flush()
+					panic(http.ErrAbortHandler)
+				}
+				if rng := r.Header.Get("Range"); tt.honourRange && rng != "" {
+					start, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"), 10, 64)
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(body)-1, len(body)))
+					w.WriteHeader(http.StatusPartialContent)
+					w.Write(body[start:])
+					return
+				}
+				w.Write(body)
+			}))
+			defer srv.Close()
+
+			res, err := Download(srv.URL+"/a.png", "test", DownloadOptions{
+				Client:      srv.Client(),
+				MemoryLimit: tt.memLimit,
+				MaxSize:     1 << 20,
+				Timeout:     5 * time.Second,
+				Retries:     2,
+			})
+			if err != nil {
+				t.Fatalf("Download: %v", err)
+			}
+			defer res.Cleanup()
+
+			if requests.Load() != 2 {
+				t.Errorf("made %d requests, want 2", requests.Load())
+			}
+			if want := fmt.Sprintf("bytes=%d-", cut); ranges[1] != want {
+				t.Errorf("second request Range = %q, want %q", ranges[1], want)
+			}
+			f, err := res.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var got bytes.Buffer
+			got.ReadFrom(f)
+			if !bytes.Equal(got.Bytes(), body) {
+				t.Errorf("downloaded %d bytes that differ from the %d served", got.Len(), len(body))
+			}
+			if res.Format != "png" || res.Width != 48 || res.Height != 32 {
+				t.Errorf("got %s %dx%d, want png 48x32", res.Format, res.Width, res.Height)
+			}
+			if res.InMemory() != (tt.memLimit > int64(len(body))) {
+				t.Errorf("InMemory = %t with memory limit %d", res.InMemory(), tt.memLimit)
+			}
+		})
+	}
+}
+
+func TestDownloadDoesNotRetryBadStatus(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	_, err := Download(srv.URL+"/a.png", "test", DownloadOptions{
+		Client:      srv.Client(),
+		MemoryLimit: 1 << 20,
+		MaxSize:     1 << 20,
+		Timeout:     5 * time.Second,
+		Retries:     3,
+	})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Download error = %v, want a 404", err)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("made %d requests, want 1", requests.Load())
+	}
+}
@@ -0,0 +1,246 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+)
+
+type ImageInfo struct {
+	Format   string
+	Width    int
+	Height   int
+	Animated bool
+}
+
+var (
+	errHTMLPage      = errors.New("got a web page or API error instead of an image")
+	errUnknownFormat = errors.New("unrecognized image format")
+	errTruncated     = errors.New("image data is truncated")
+)
+
+// sniffFormat identifies an image by its leading bytes.
+func sniffFormat(head []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return "jpeg", nil
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return "png", nil
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return "gif", nil
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return "webp", nil
+	}
+
+	trimmed := bytes.ToLower(bytes.TrimLeft(head, " \t\r\n\xef\xbb\xbf"))
+	if bytes.HasPrefix(trimmed, []byte("<!doctype")) || bytes.HasPrefix(trimmed, []byte("<html")) ||
+		bytes.HasPrefix(trimmed, []byte("<?xml")) || bytes.HasPrefix(trimmed, []byte("{")) {
+		return "", errHTMLPage
+	}
+	return "", errUnknownFormat
+}
+
+// hasTrailer checks the end-of-image marker each format requires, which
+// catches downloads that stopped part way through.
+func hasTrailer(format string, tail []byte, size int64, head []byte) bool {
+	switch format {
+	case "jpeg":
+		// Some encoders pad or append a few bytes after the EOI marker.
+		return bytes.Contains(tail, []byte{0xFF, 0xD9})
+	case "png":
+		return bytes.HasSuffix(tail, []byte("IEND\xaeB`\x82"))
+	case "gif":
+		return bytes.HasSuffix(tail, []byte{0x3B})
+	case "webp":
+		riffSize := int64(binary.LittleEndian.Uint32(head[4:8]))
+		return riffSize+8 <= size
+	}
+	return false
+}
+
+// webpSize reads the canvas size from the first chunk of a WebP file.
+func webpSize(head []byte) (int, int, error) {
+	if len(head) < 30 {
+		return 0, 0, errTruncated
+	}
+	switch string(head[12:16]) {
+	case "VP8 ":
+		if head[23] != 0x9D || head[24] != 0x01 || head[25] != 0x2A {
+			return 0, 0, errors.New("bad VP8 frame header")
+		}
+		w := int(binary.LittleEndian.Uint16(head[26:28]) & 0x3FFF)
+		h := int(binary.LittleEndian.Uint16(head[28:30]) & 0x3FFF)
+		return w, h, nil
+	case "VP8L":
+		if head[20] != 0x2F {
+			return 0, 0, errors.New("bad VP8L signature")
+		}
+		bits := binary.LittleEndian.Uint32(head[21:25])
+		return int(bits&0x3FFF) + 1, int((bits>>14)&0x3FFF) + 1, nil
+	case "VP8X":
+		w := int(head[24]) | int(head[25])<<8 | int(head[26])<<16
+		h := int(head[27]) | int(head[28])<<8 | int(head[29])<<16
+		return w + 1, h + 1, nil
+	}
+	return 0, 0, fmt.Errorf("unknown WebP chunk %q", head[12:16])
+}
+
+// webpAnimated reports whether an extended WebP has the animation flag set.
+func webpAnimated(head []byte) bool {
+	return len(head) > 20 && string(head[12:16]) == "VP8X" && head[20]&0x02 != 0
+}
+
+// gifFrameCount walks the GIF block structure and counts image
+// descriptors, stopping once a second frame is found.
+func gifFrameCount(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, err
+	}
+	if header[10]&0x80 != 0 {
+		if _, err := br.Discard(3 << (header[10]&0x07 + 1)); err != nil {
+			return 0, err
+		}
+	}
+
+	skipSubBlocks := func() error {
+		for {
+			n, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return nil
+			}
+			if _, err := br.Discard(int(n)); err != nil {
+				return err
+			}
+		}
+	}
+
+	frames := 0
+	for frames < 2 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return frames, err
+		}
+		switch b {
+		case 0x21:
+			if _, err := br.ReadByte(); err != nil {
+				return frames, err
+			}
+			if err := skipSubBlocks(); err != nil {
+				return frames, err
+			}
+		case 0x2C:
+			desc := make([]byte, 9)
+			if _, err := io.ReadFull(br, desc); err != nil {
+				return frames, err
+			}
+			if desc[8]&0x80 != 0 {
+				if _, err := br.Discard(3 << (desc[8]&0x07 + 1)); err != nil {
+					return frames, err
+				}
+			}
+			if _, err := br.ReadByte(); err != nil {
+				return frames, err
+			}
+			if err := skipSubBlocks(); err != nil {
+				return frames, err
+			}
+			frames++
+		case 0x3B:
+			return frames, nil
+		default:
+			return frames, fmt.Errorf("unexpected GIF block 0x%02x", b)
+		}
+	}
+	return frames, nil
+}
+
+// InspectImage validates the file at path by its content rather than by
+// the Content-Type it was served with, and reads its dimensions.
+func InspectImage(path string) (ImageInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	return inspect(f, st.Size())
+}
+
+// InspectBytes is InspectImage for an in-memory download.
+func InspectBytes(data []byte) (ImageInfo, error) {
+	return inspect(bytes.NewReader(data), int64(len(data)))
+}
+
+func inspect(r io.ReaderAt, size int64) (ImageInfo, error) {
+	head := make([]byte, 64)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return ImageInfo{}, err
+	}
+	head = head[:n]
+
+	format, err := sniffFormat(head)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+
+	tail := make([]byte, 16)
+	if size < int64(len(tail)) {
+		tail = tail[:size]
+	}
+	if _, err := r.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return ImageInfo{}, err
+	}
+	if !hasTrailer(format, tail, size, head) {
+		return ImageInfo{}, errTruncated
+	}
+
+	info := ImageInfo{Format: format}
+	switch format {
+	case "webp":
+		info.Width, info.Height, err = webpSize(head)
+		info.Animated = webpAnimated(head)
+	case "gif":
+		var frames int
+		if frames, err = gifFrameCount(io.NewSectionReader(r, 0, size)); err != nil {
+			return ImageInfo{}, fmt.Errorf("corrupted gif: %w", err)
+		}
+		info.Animated = frames > 1
+		fallthrough
+	default:
+		var cfg image.Config
+		cfg, _, err = image.DecodeConfig(io.NewSectionReader(r, 0, size))
+		info.Width, info.Height = cfg.Width, cfg.Height
+	}
+	if err != nil {
+		return ImageInfo{}, fmt.Errorf("corrupted %s header: %w", format, err)
+	}
+	if info.Width <= 0 || info.Height <= 0 {
+		return ImageInfo{}, fmt.Errorf("invalid %s dimensions %dx%d", format, info.Width, info.Height)
+	}
+	return info, nil
+}
+
+var formatExt = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+	"webp": ".webp",
+}
@@ -0,0 +1,172 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"testing"
+)
+
+func TestSniffFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want string
+		err  error
+	}{
+		{"jpeg", "\xFF\xD8\xFF\xE0\x00\x10JFIF", "jpeg", nil},
+		{"png", "\x89PNG\r\n\x1a\n\x00\x00", "png", nil},
+		{"gif87a", "GIF87a\x01\x00", "gif", nil},
+		{"gif89a", "GIF89a\x01\x00", "gif", nil},
+		{"webp", "RIFF\x24\x00\x00\x00WEBPVP8 ", "webp", nil},
+		{"riff but not webp", "RIFF\x24\x00\x00\x00WAVEfmt ", "", errUnknownFormat},
+		{"short riff", "RIFF\x24\x00", "", errUnknownFormat},
+		{"html", "<!DOCTYPE html><html>", "", errHTMLPage},
+		{"html with bom and space", "\xef\xbb\xbf  \n<HTML><body>", "", errHTMLPage},
+		{"xml", "<?xml version=\"1.0\"?>", "", errHTMLPage},
+		{"json error", "{\"error\":\"rate limited\"}", "", errHTMLPage},
+		{"empty", "", "", errUnknownFormat},
+		{"text", "hello", "", errUnknownFormat},
+	}
+	for _, tt := range tests {
+		got, err := sniffFormat([]byte(tt.head))
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("%s: sniffFormat = %q, %v; want %q, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// webpHead builds the first 30 bytes of a WebP file whose first chunk is
+// kind, letting fill write the chunk payload from offset 20 on.
+func webpHead(kind string, fill func(b []byte)) []byte {
+	b := make([]byte, 30)
+	copy(b, "RIFF")
+	binary.LittleEndian.PutUint32(b[4:], 1000)
+	copy(b[8:], "WEBP")
+	copy(b[12:], kind)
+	binary.LittleEndian.PutUint32(b[16:], 100)
+	fill(b)
+	return b
+}
+
+func TestWebpSize(t *testing.T) {
+	vp8 := webpHead("VP8 ", func(b []byte) {
+		copy(b[23:], []byte{0x9D, 0x01, 0x2A})
+		// The top two bits of each dimension are a scale and are ignored.
+		binary.LittleEndian.PutUint16(b[26:], 640|0xC000)
+		binary.LittleEndian.PutUint16(b[28:], 480)
+	})
+	vp8BadStart := webpHead("VP8 ", func(b []byte) {
+		copy(b[23:], []byte{0x00, 0x01, 0x2A})
+	})
+	vp8l := webpHead("VP8L", func(b []byte) {
+		b[20] = 0x2F
+		binary.LittleEndian.PutUint32(b[21:], (1920-1)|(1080-1)<<14)
+	})
+	vp8lBadSig := webpHead("VP8L", func(b []byte) {
+		b[20] = 0x00
+	})
+	vp8x := webpHead("VP8X", func(b []byte) {
+		b[20] = 0x02 // animation flag
+		w, h := 5000-1, 70000-1
+		b[24], b[25], b[26] = byte(w), byte(w>>8), byte(w>>16)
+		b[27], b[28], b[29] = byte(h), byte(h>>8), byte(h>>16)
+	})
+	unknown := webpHead("ALPH", func([]byte) {})
+
+	tests := []struct {
+		name     string
+		head     []byte
+		w, h     int
+		animated bool
+		wantErr  bool
+	}{
+		{"lossy", vp8, 640, 480, false, false},
+		{"lossy bad start code", vp8BadStart, 0, 0, false, true},
+		{"lossless", vp8l, 1920, 1080, false, false},
+		{"lossless bad signature", vp8lBadSig, 0, 0, false, true},
+		{"extended animated", vp8x, 5000, 70000, true, false},
+		{"unknown chunk", unknown, 0, 0, false, true},
+		{"truncated", vp8[:29], 0, 0, false, true},
+	}
+	for _, tt := range tests {
+		w, h, err := webpSize(tt.head)
+		if w != tt.w || h != tt.h || (err != nil) != tt.wantErr {
+			t.Errorf("%s: webpSize = %dx%d, %v; want %dx%d, error %t", tt.name, w, h, err, tt.w, tt.h, tt.wantErr)
+		}
+		if got := webpAnimated(tt.head); got != tt.animated {
+			t.Errorf("%s: webpAnimated = %t, want %t", tt.name, got, tt.animated)
+		}
+	}
+}
+
+func encodeGIF(t *testing.T, frames int, localPalette bool) []byte {
+	t.Helper()
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		img := image.NewPaletted(image.Rect(0, 0, 8, 8), palette.Plan9[:16])
+		img.SetColorIndex(i%8, i%8, uint8(i+1))
+		if localPalette && i%2 == 1 {
+			img.Palette = color.Palette{color.Black, color.White, color.Gray{Y: 0x80}, color.Transparent}
+		}
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGifFrameCount(t *testing.T) {
+	still := encodeGIF(t, 1, false)
+	animated := encodeGIF(t, 5, false)
+	mixed := encodeGIF(t, 2, true)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    int
+		wantErr bool
+	}{
+		{"single frame", still, 1, false},
+		// Counting stops at the second frame.
+		{"animated", animated, 2, false},
+		{"local color table", mixed, 2, false},
+		{"truncated header", still[:10], 0, true},
+		{"truncated frame", still[:len(still)-8], 0, true},
+		{"bad block", append(append([]byte{}, still[:len(still)-1]...), 0x99), 1, true},
+	}
+	for _, tt := range tests {
+		got, err := gifFrameCount(bytes.NewReader(tt.data))
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%s: gifFrameCount = %d, %v; want %d, error %t", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestInspectBytesGIF(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		animated bool
+	}{
+		{"still", encodeGIF(t, 1, false), false},
+		{"animated", encodeGIF(t, 3, false), true},
+	}
+	for _, tt := range tests {
+		info, err := InspectBytes(tt.data)
+		if err != nil {
+			t.Errorf("%s: InspectBytes: %v", tt.name, err)
+			continue
+		}
+		if info.Format != "gif" || info.Width != 8 || info.Height != 8 || info.Animated != tt.animated {
+			t.Errorf("%s: InspectBytes = %+v, want 8x8 gif, animated %t", tt.name, info, tt.animated)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package util
+
+import "image"
+
+// DHash computes a 64-bit difference hash: the image is shrunk to 9x8
+// grayscale and each bit records whether a pixel is brighter than its
+// right neighbour. Re-encoded or resized copies of the same artwork end up
+// within a few bits of each other.
+func DHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	small := downscale(img, 64)
+	sw, sh := small.Bounds().Dx(), small.Bounds().Dy()
+
+	var gray [h][w]uint32
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+			var sum, n uint32
+			for py := y0; py < y1; py++ {
+				for px := x0; px < x1; px++ {
+					o := py*small.Stride + px*4
+					r, g, b := uint32(small.Pix[o]), uint32(small.Pix[o+1]), uint32(small.Pix[o+2])
+					sum += (299*r + 587*g + 114*b) / 1000
+					n++
+				}
+			}
+			gray[y][x] = sum / n
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
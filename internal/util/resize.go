@@ -0,0 +1,188 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Telegram's limits for sendPhoto.
+const (
+	MaxPhotoBytes = 10 * 1024 * 1024
+	maxPhotoSides = 10000
+	maxPhotoRatio = 20
+
+	// Telegram stores photos at most 2560px on the long side, so larger
+	// images only cost upload time.
+	photoLongSide = 2560
+
+	// maxDecodePixels bounds the images we decode at all; a 40 MP RGBA
+	// buffer alone is 160 MB.
+	maxDecodePixels = 40_000_000
+)
+
+var ErrNotPhotoCompatible = errors.New("image cannot be sent as a photo")
+
+// FitsPhotoLimits reports whether an image can go through sendPhoto as is.
+func FitsPhotoLimits(size int64, width, height int) bool {
+	if size > MaxPhotoBytes || width+height > maxPhotoSides {
+		return false
+	}
+	long, short := max(width, height), min(width, height)
+	return short > 0 && long <= short*maxPhotoRatio
+}
+
+// PreparePhoto returns a download that sendPhoto will accept: res itself
+// when it already fits, otherwise an in-memory downscaled JPEG. The
+// original is left untouched. Images with an extreme aspect ratio, more
+// than maxDecodePixels pixels or a format the standard library cannot
+// decode return ErrNotPhotoCompatible.
+func PreparePhoto(res *DownloadResult) (photo *DownloadResult, resized bool, err error) {
+	if FitsPhotoLimits(res.FileSize, res.Width, res.Height) {
+		return res, false, nil
+	}
+	long, short := max(res.Width, res.Height), min(res.Width, res.Height)
+	if short <= 0 || long > short*maxPhotoRatio {
+		return nil, false, fmt.Errorf("%w: aspect ratio %dx%d", ErrNotPhotoCompatible, res.Width, res.Height)
+	}
+	if res.Width*res.Height > maxDecodePixels {
+		return nil, false, fmt.Errorf("%w: %dx%d is too large to decode", ErrNotPhotoCompatible, res.Width, res.Height)
+	}
+	if res.Format == "webp" {
+		return nil, false, fmt.Errorf("%w: cannot decode webp", ErrNotPhotoCompatible)
+	}
+
+	f, err := res.Open()
+	if err != nil {
+		return nil, false, err
+	}
+	src, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	dst := downscale(src, photoLongSide)
+
+	var buf bytes.Buffer
+	for _, quality := range []int{90, 80, 70, 60} {
+		buf.Reset()
+		if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, false, fmt.Errorf("failed to encode jpeg: %w", err)
+		}
+		if buf.Len() <= MaxPhotoBytes {
+			break
+		}
+	}
+	if buf.Len() > MaxPhotoBytes {
+		return nil, false, fmt.Errorf("%w: still %d bytes after recompression", ErrNotPhotoCompatible, buf.Len())
+	}
+
+	b := dst.Bounds()
+	log.Printf("Resized %dx%d %s (%.2f MB) to %dx%d jpeg (%.2f MB)",
+		res.Width, res.Height, res.Format, float64(res.FileSize)/(1024*1024),
+		b.Dx(), b.Dy(), float64(buf.Len())/(1024*1024))
+
+	return &DownloadResult{
+		Name:     strings.TrimSuffix(res.Name, filepath.Ext(res.Name)) + "_photo.jpg",
+		Data:     buf.Bytes(),
+		FileSize: int64(buf.Len()),
+		Format:   "jpeg",
+		Width:    b.Dx(),
+		Height:   b.Dy(),
+	}, true, nil
+}
+
+// downscale shrinks src so its long side is at most longSide, averaging
+// every source pixel that falls into a destination pixel. Pixels are read
+// straight from src, so only the destination is allocated. Transparent
+// areas are flattened onto white since the result is encoded as JPEG.
+func downscale(src image.Image, longSide int) *image.RGBA {
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+
+	dw, dh := sw, sh
+	if max(sw, sh) > longSide {
+		if sw >= sh {
+			dw, dh = longSide, max(1, sh*longSide/sw)
+		} else {
+			dw, dh = max(1, sw*longSide/sh), longSide
+		}
+	}
+
+	at := pixelReader(src)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		y0, y1 := dy*sh/dh, (dy+1)*sh/dh
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for dx := 0; dx < dw; dx++ {
+			x0, x1 := dx*sw/dw, (dx+1)*sw/dw
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, n uint32
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					pr, pg, pb := at(sb.Min.X+x, sb.Min.Y+y)
+					r += pr
+					g += pg
+					b += pb
+					n++
+				}
+			}
+
+			o := dy*dst.Stride + dx*4
+			dst.Pix[o] = uint8(r / n)
+			dst.Pix[o+1] = uint8(g / n)
+			dst.Pix[o+2] = uint8(b / n)
+			dst.Pix[o+3] = 0xFF
+		}
+	}
+	return dst
+}
+
+// pixelReader returns a function yielding the 8-bit colour at (x, y),
+// flattened onto white. The decoders' common image types are read from
+// their buffers directly; anything else goes through At.
+func pixelReader(src image.Image) func(x, y int) (r, g, b uint32) {
+	switch img := src.(type) {
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32) {
+			yi, ci := img.YOffset(x, y), img.COffset(x, y)
+			r, g, b := color.YCbCrToRGB(img.Y[yi], img.Cb[ci], img.Cr[ci])
+			return uint32(r), uint32(g), uint32(b)
+		}
+	case *image.Gray:
+		return func(x, y int) (uint32, uint32, uint32) {
+			v := uint32(img.Pix[img.PixOffset(x, y)])
+			return v, v, v
+		}
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32) {
+			p := img.Pix[img.PixOffset(x, y):]
+			bg := 0xFF - uint32(p[3])
+			return uint32(p[0]) + bg, uint32(p[1]) + bg, uint32(p[2]) + bg
+		}
+	case *image.NRGBA:
+		return func(x, y int) (uint32, uint32, uint32) {
+			p := img.Pix[img.PixOffset(x, y):]
+			a := uint32(p[3])
+			bg := 0xFF - a
+			return uint32(p[0])*a/0xFF + bg, uint32(p[1])*a/0xFF + bg, uint32(p[2])*a/0xFF + bg
+		}
+	}
+	return func(x, y int) (uint32, uint32, uint32) {
+		r, g, b, a := src.At(x, y).RGBA()
+		bg := 0xFFFF - a
+		return (r + bg) >> 8, (g + bg) >> 8, (b + bg) >> 8
+	}
+}